@@ -1,40 +1,99 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	filter "onebotfiler/src"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: func(r *http.Request) bool {
+			if !filter.CheckOrigin(r) {
+				log.Printf("拒绝了来自%s的OneBot客户端连接：Origin %s 不被允许\n", r.RemoteAddr, r.Header.Get("Origin"))
+				return false
+			}
+			return true
+		},
 	}
-	wss = &filter.WsServer{}
 )
 
 func handleLocal(w http.ResponseWriter, r *http.Request) {
-	if wss.Conn != nil {
-		http.Error(w, "只能连接一个OneBot客户端", http.StatusForbidden)
+	if status, reason := filter.CheckOneBotRequest(r); status != 0 {
+		log.Printf("拒绝了来自%s的OneBot客户端连接：%s\n", r.RemoteAddr, reason)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	// 用x-self-id区分不同的账号
+	selfId := r.Header.Get("X-Self-ID")
+	if selfId == "" {
+		selfId = filter.CONFIG.Server.BotId
+	}
+	if selfId == "" {
+		http.Error(w, "缺少X-Self-ID", http.StatusBadRequest)
+		return
+	}
+	if wss := filter.LookupWsServer(selfId); wss != nil && wss.Connected() {
+		http.Error(w, fmt.Sprintf("账号%s已经连接了OneBot客户端", selfId), http.StatusForbidden)
 		return
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("OneBot客户端连接异常：", err)
+		log.Printf("账号%s的OneBot客户端连接异常：%v\n", selfId, err)
 		return
 	}
+	// 连接成功后才创建账号，避免无效的连接请求留下账号和bot应用连接
+	wss := filter.GetWsServer(selfId)
 	// defer conn.Close()
-	wss.Conn = conn
-	log.Println("已连接到OneBot客户端")
+	if err = wss.Attach(conn); err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	log.Printf("已连接到账号%s的OneBot客户端\n", selfId)
 	err = wss.WsServerHandler()
 	if err != nil {
-		log.Println("OneBot客户端连接异常：", err)
+		log.Printf("账号%s的OneBot客户端连接异常：%v\n", selfId, err)
 	}
 	//循环结束
-	log.Println("OneBot客户端连接已断开")
+	log.Printf("账号%s的OneBot客户端连接已断开\n", selfId)
+}
+
+// 在listener上提供服务，出错时退出程序
+func serve(server *http.Server, listener net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal("监听服务出错:", err)
+	}
+}
+
+// 启用的监听地址加上路径，用于日志，unix socket的地址与bot应用uri的格式相同
+func listenUrls(scheme, path string) string {
+	var urls []string
+	if filter.CONFIG.Server.Port != 0 {
+		urls = append(urls, fmt.Sprintf("%s://%s:%d%s", scheme, filter.CONFIG.Server.Host, filter.CONFIG.Server.Port, path))
+	}
+	if filter.CONFIG.Server.UnixSocket.Path != "" {
+		urls = append(urls, fmt.Sprintf("%s%s:%s", filter.UNIX_URI_PREFIX, filter.CONFIG.Server.UnixSocket.Path, path))
+	}
+	return strings.Join(urls, " ")
 }
 
 func main() {
@@ -44,15 +103,80 @@ func main() {
 	}
 	upgrader.ReadBufferSize = filter.CONFIG.Server.BufferSize
 	upgrader.WriteBufferSize = filter.CONFIG.Server.BufferSize
-	http.HandleFunc(filter.CONFIG.Server.Suffix, handleLocal)
-	go func() {
-		for _, bacfg := range filter.CONFIG.BotApps {
-			go filter.WsClientHandler(wss, bacfg)
+	upgrader.EnableCompression = filter.CONFIG.Server.Compression.Enable
+	server := &http.Server{Addr: fmt.Sprintf("%s:%d", filter.CONFIG.Server.Host, filter.CONFIG.Server.Port)}
+	wsScheme, httpScheme := "ws", "http"
+	if filter.CONFIG.Server.TLS.CertFile != "" {
+		certReloader, err := filter.NewCertReloader(filter.CONFIG.Server.TLS.CertFile, filter.CONFIG.Server.TLS.KeyFile)
+		if err != nil {
+			log.Fatal("加载证书异常:", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certReloader.GetCertificate}
+		wsScheme, httpScheme = "wss", "https"
+	}
+	switch filter.CONFIG.Server.Mode {
+	case filter.MODE_FORWARD:
+		// 正向ws，由本程序连接OneBot客户端
+		for _, fcfg := range filter.CONFIG.Server.Forward {
+			go filter.ForwardHandler(fcfg)
+		}
+	default:
+		// 反向ws，等待OneBot客户端连接
+		http.HandleFunc(filter.CONFIG.Server.Suffix, handleLocal)
+	}
+	// 由bot应用主动连接本程序的路径，以及http api
+	for _, bacfg := range filter.CONFIG.BotApps {
+		if bacfg.ListenPath != "" {
+			http.HandleFunc(bacfg.ListenPath, filter.BotAppHandler(bacfg))
+			log.Printf("%s可以连接 %s\n", bacfg.Name, listenUrls(wsScheme, bacfg.ListenPath))
+		}
+		if bacfg.HttpApi != "" {
+			// 以/结尾，匹配这个路径下的所有动作
+			http.HandleFunc(strings.TrimSuffix(bacfg.HttpApi, "/")+"/", filter.BotAppHttpHandler(bacfg))
+			log.Printf("%s可以使用http api %s\n", bacfg.Name, listenUrls(httpScheme, bacfg.HttpApi))
 		}
-	}()
+	}
+	if filter.CONFIG.Server.StatusPath != "" {
+		http.HandleFunc(filter.CONFIG.Server.StatusPath, filter.StatusHandler)
+	}
+	// 默认账号在启动时就连接bot应用，其他账号在OneBot客户端连接时再连接
+	if filter.CONFIG.Server.BotId != "" {
+		filter.GetWsServer(filter.CONFIG.Server.BotId)
+	}
 
-	log.Printf("OneBotFilter已启动 ws://%s:%d%s\n", filter.CONFIG.Server.Host, filter.CONFIG.Server.Port, filter.CONFIG.Server.Suffix)
-	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", filter.CONFIG.Server.Host, filter.CONFIG.Server.Port), nil); err != nil {
-		log.Fatal("监听服务出错:", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// 统计每个连接的流量
+	if filter.CONFIG.Server.Port != 0 {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatal("监听服务出错:", err)
+		}
+		go serve(server, filter.CountingListener(listener), server.TLSConfig != nil)
+	}
+	if filter.CONFIG.Server.UnixSocket.Path != "" {
+		// unix socket只在本机访问，不使用tls
+		listener, err := filter.ListenUnix(filter.CONFIG.Server.UnixSocket)
+		if err != nil {
+			log.Fatal("监听unix socket出错:", err)
+		}
+		go serve(server, filter.CountingListener(listener), false)
+	}
+	log.Printf("OneBotFilter已启动 %s\n", listenUrls(wsScheme, filter.CONFIG.Server.Suffix))
+	<-ctx.Done()
+	stop() // 再次收到信号时直接退出
+	log.Println("收到退出信号，正在关闭连接...")
+	filter.BeginShutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(filter.CONFIG.Server.ShutdownTimeout*float64(time.Second)))
+	defer cancel()
+	// 不再接受新的连接，等待正在处理的http请求完成
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Println("关闭监听服务出错:", err)
+	}
+	if err = filter.Shutdown(shutdownCtx); err != nil {
+		log.Println("退出时出错:", err)
+		cancel()
+		os.Exit(1)
 	}
+	log.Println("OneBotFilter已退出")
 }
@@ -0,0 +1,206 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// 等待OneBot客户端响应的动作请求
+type pendingAction struct {
+	clientName string          // 发出请求的bot应用
+	echo       json.RawMessage // bot应用原本的echo，为nil时表示原本没有echo
+	respChan   chan []byte     // 不为nil时，响应发送到这里，而不是发给bot应用（http api使用）
+	timer      *time.Timer     // 等待响应超时的计时器
+}
+
+// bot应用发出的动作请求
+type OneBotAction struct {
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Echo   json.RawMessage `json:"echo,omitempty"`
+}
+
+// 本程序自己生成的动作响应
+type OneBotResponse struct {
+	Status  string          `json:"status"`
+	Retcode int             `json:"retcode"`
+	Data    any             `json:"data"`
+	Message string          `json:"message,omitempty"`
+	Wording string          `json:"wording,omitempty"`
+	Echo    json.RawMessage `json:"echo,omitempty"`
+}
+
+// 解析动作请求，不是动作请求时返回nil
+func ParseOneBotAction(msg []byte) *OneBotAction {
+	var action OneBotAction
+	if err := json.Unmarshal(msg, &action); err != nil || action.Action == "" {
+		return nil
+	}
+	return &action
+}
+
+// 生成失败的动作响应
+func NewFailedResponse(retcode int, message string, echo json.RawMessage) []byte {
+	resp, _ := json.Marshal(OneBotResponse{
+		Status:  "failed",
+		Retcode: retcode,
+		Message: message,
+		Wording: message,
+		Echo:    echo,
+	})
+	return resp
+}
+
+// 用于区分事件和动作响应的字段
+type oneBotFrameHead struct {
+	PostType      string          `json:"post_type"`
+	MetaEventType string          `json:"meta_event_type"`
+	MessageType   string          `json:"message_type"`
+	NoticeType    string          `json:"notice_type"`
+	RequestType   string          `json:"request_type"`
+	Echo          json.RawMessage `json:"echo"`
+}
+
+// 是否为OneBot客户端上报的事件
+func isEvent(msg []byte) bool {
+	var head oneBotFrameHead
+	if err := json.Unmarshal(msg, &head); err != nil {
+		return false
+	}
+	return head.PostType != ""
+}
+
+// 把bot应用发出的动作请求的echo替换为带有bot应用名字的echo，并记录到等待表中
+// 无法解析的消息原样返回，此时key为空
+func (wss *WsServer) wrapAction(clientName string, msg []byte, respChan chan []byte) (newMsg []byte, key string) {
+	var action map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &action); err != nil {
+		return msg, ""
+	}
+	if _, ok := action["action"]; !ok {
+		return msg, ""
+	}
+	echo := fmt.Sprintf("%s#%d", clientName, wss.echoSeq.Add(1))
+	newEcho, err := json.Marshal(echo)
+	if err != nil {
+		return msg, ""
+	}
+	data := action["echo"]
+	action["echo"] = newEcho
+	newMsg, err = json.Marshal(action)
+	if err != nil {
+		log.Printf("替换%s的echo出错：%v\n", clientName, err)
+		return msg, ""
+	}
+	wss.pendingMutex.Lock()
+	defer wss.pendingMutex.Unlock()
+	if wss.pending == nil {
+		wss.pending = make(map[string]pendingAction)
+	}
+	pa := pendingAction{clientName: clientName, echo: data, respChan: respChan}
+	if CONFIG.Server.ActionTimeout > 0 {
+		pa.timer = time.AfterFunc(seconds(CONFIG.Server.ActionTimeout), func() { wss.expirePending(echo) })
+	}
+	wss.pending[echo] = pa
+	return newMsg, echo
+}
+
+// 从等待表中删除
+func (wss *WsServer) removePending(key string) {
+	wss.pendingMutex.Lock()
+	defer wss.pendingMutex.Unlock()
+	if pa, ok := wss.pending[key]; ok && pa.timer != nil {
+		pa.timer.Stop()
+	}
+	delete(wss.pending, key)
+}
+
+// 等待响应超时，回复失败的响应
+func (wss *WsServer) expirePending(key string) {
+	wss.pendingMutex.Lock()
+	pa, ok := wss.pending[key]
+	delete(wss.pending, key)
+	wss.pendingMutex.Unlock()
+	if !ok {
+		return
+	}
+	log.Printf("%s的动作请求等待响应超时\n", pa.clientName)
+	wss.replyPending(pa, NewFailedResponse(RETCODE_TIMEOUT, "等待OneBot客户端响应超时", pa.echo))
+}
+
+// 把响应发给发出请求的bot应用
+func (wss *WsServer) replyPending(pa pendingAction, resp []byte) {
+	if pa.respChan != nil {
+		select {
+		case pa.respChan <- resp:
+		default:
+		}
+		return
+	}
+	wsClient := wss.getWsClient(pa.clientName)
+	if wsClient == nil {
+		return
+	}
+	if err := wsClient.writeResponse(resp); err != nil {
+		log.Printf("向 %s 发送消息出错：%v\n", wsClient.Name, err)
+	}
+}
+
+// 如果消息是动作响应，找到发出请求的bot应用并还原echo
+// ok为false表示消息不是动作响应，pa.clientName为空表示找不到发出请求的bot应用
+func (wss *WsServer) unwrapResponse(msg []byte) (pa pendingAction, newMsg []byte, ok bool) {
+	var head oneBotFrameHead
+	if err := json.Unmarshal(msg, &head); err != nil {
+		return pa, nil, false
+	}
+	if head.PostType != "" || len(head.Echo) == 0 {
+		return pa, nil, false
+	}
+	var echo string
+	if err := json.Unmarshal(head.Echo, &echo); err != nil || !strings.Contains(echo, "#") {
+		// 不是本程序生成的echo，当作无主的响应处理
+		return pa, nil, true
+	}
+	wss.pendingMutex.Lock()
+	pa, found := wss.pending[echo]
+	delete(wss.pending, echo)
+	wss.pendingMutex.Unlock()
+	if !found {
+		return pendingAction{}, nil, true
+	}
+	if pa.timer != nil {
+		pa.timer.Stop()
+	}
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &response); err != nil {
+		return pendingAction{}, nil, true
+	}
+	if pa.echo == nil {
+		delete(response, "echo")
+	} else {
+		response["echo"] = pa.echo
+	}
+	newMsg, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("还原%s的echo出错：%v\n", pa.clientName, err)
+		return pendingAction{}, nil, true
+	}
+	return pa, newMsg, true
+}
+
+// 清空等待表，并回复失败的响应，OneBot客户端断开后不会再有响应
+func (wss *WsServer) failPending(retcode int, message string) {
+	wss.pendingMutex.Lock()
+	pending := wss.pending
+	wss.pending = nil
+	wss.pendingMutex.Unlock()
+	for _, pa := range pending {
+		if pa.timer != nil {
+			pa.timer.Stop()
+		}
+		wss.replyPending(pa, NewFailedResponse(retcode, message, pa.echo))
+	}
+}
@@ -0,0 +1,240 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 一条消息收到的回复，等待仲裁窗口结束后只发送优先级最高的bot应用的回复
+type replyContest struct {
+	candidates []replyCandidate
+	decided    bool
+	winner     string    // 仲裁结束后，之后的回复只有winner的可以发送
+	expire     time.Time // 超过这个时间后删除
+}
+
+type replyCandidate struct {
+	clientName string
+	priority   int
+	decide     func(win bool) // 仲裁结束后调用，win为false时需要回复仲裁失败的响应
+}
+
+// 最近一次收到的消息，用于关联没有回复消息段的回复
+type recentMessage struct {
+	messageId string
+	time      time.Time
+}
+
+// 仲裁需要的消息事件字段
+type arbitrationEvent struct {
+	PostType    string          `json:"post_type"`
+	MessageType string          `json:"message_type"`
+	MessageId   json.RawMessage `json:"message_id"`
+	UserId      json.RawMessage `json:"user_id"`
+	GroupId     json.RawMessage `json:"group_id"`
+}
+
+// 发送消息的动作参数
+type sendMsgParams struct {
+	MessageType string          `json:"message_type"`
+	UserId      json.RawMessage `json:"user_id"`
+	GroupId     json.RawMessage `json:"group_id"`
+	Message     json.RawMessage `json:"message"`
+}
+
+// 记录OneBot客户端发来的消息事件，之后发到同一个会话的回复与它关联
+func (wss *WsServer) recordMessage(data []byte) {
+	if !CONFIG.Server.Arbitration.Enable {
+		return
+	}
+	var event arbitrationEvent
+	if err := json.Unmarshal(data, &event); err != nil || event.PostType != "message" || len(event.MessageId) == 0 {
+		return
+	}
+	key := chatKey(event.MessageType, event.UserId, event.GroupId)
+	if key == "" {
+		return
+	}
+	wss.arbMutex.Lock()
+	defer wss.arbMutex.Unlock()
+	if wss.recentMessages == nil {
+		wss.recentMessages = map[string]recentMessage{}
+	}
+	wss.recentMessages[key] = recentMessage{messageId: jsonId(event.MessageId), time: time.Now()}
+}
+
+// 对发送消息的动作进行仲裁，返回false表示不需要仲裁，直接发送
+// 返回true时，仲裁结束后会调用decide
+func (wss *WsServer) arbitrate(clientName string, priority int, action *OneBotAction, decide func(win bool)) bool {
+	arb := &CONFIG.Server.Arbitration
+	if !arb.Enable || !slices.Contains(arb.Actions, action.Action) {
+		return false
+	}
+	var params sendMsgParams
+	if err := json.Unmarshal(action.Params, &params); err != nil {
+		return false
+	}
+	messageType := params.MessageType
+	switch action.Action {
+	case "send_group_msg":
+		messageType = GROUP
+	case "send_private_msg":
+		messageType = PRIVATE
+	}
+	if messageType == "" {
+		messageType = PRIVATE
+		if len(params.GroupId) > 0 {
+			messageType = GROUP
+		}
+	}
+
+	wss.arbMutex.Lock()
+	now := time.Now()
+	// 优先使用回复消息段关联，没有时关联这个会话最近的一条消息
+	trigger := replyId(params.Message)
+	if trigger == "" {
+		recent, ok := wss.recentMessages[chatKey(messageType, params.UserId, params.GroupId)]
+		if !ok || now.Sub(recent.time) > seconds(arb.LinkTimeout) {
+			wss.arbMutex.Unlock()
+			return false
+		}
+		trigger = recent.messageId
+	}
+	wss.cleanContests(now)
+	if wss.contests == nil {
+		wss.contests = map[string]*replyContest{}
+	}
+	contest, ok := wss.contests[trigger]
+	if ok && contest.decided {
+		wss.arbMutex.Unlock()
+		// 仲裁已经结束，在link-timeout内只有胜出的bot应用可以继续回复这条消息
+		decide(contest.winner == clientName)
+		return true
+	}
+	if !ok {
+		contest = &replyContest{expire: now.Add(seconds(arb.LinkTimeout))}
+		wss.contests[trigger] = contest
+		time.AfterFunc(seconds(arb.Window), func() { wss.decideContest(trigger, contest) })
+	}
+	contest.candidates = append(contest.candidates, replyCandidate{clientName: clientName, priority: priority, decide: decide})
+	wss.arbMutex.Unlock()
+	return true
+}
+
+// 等待仲裁结束，返回是否可以发送，用于需要等待响应的http api和快速操作
+func (wss *WsServer) waitArbitration(clientName string, priority int, action *OneBotAction) bool {
+	result := make(chan bool, 1)
+	if !wss.arbitrate(clientName, priority, action, func(win bool) { result <- win }) {
+		return true
+	}
+	return <-result
+}
+
+// 仲裁窗口结束，优先级相同时先回复的胜出
+func (wss *WsServer) decideContest(trigger string, contest *replyContest) {
+	wss.arbMutex.Lock()
+	winner := contest.candidates[0]
+	for _, c := range contest.candidates[1:] {
+		if c.priority > winner.priority {
+			winner = c
+		}
+	}
+	contest.decided = true
+	contest.winner = winner.clientName
+	candidates := contest.candidates
+	contest.candidates = nil
+	wss.arbMutex.Unlock()
+	if slices.ContainsFunc(candidates, func(c replyCandidate) bool { return c.clientName != winner.clientName }) {
+		log.Printf("消息%s有多个bot应用回复，只发送%s的回复\n", trigger, winner.clientName)
+	}
+	// 按收到的顺序处理，同一个bot应用的多条回复保持顺序
+	for _, c := range candidates {
+		c.decide(c.clientName == winner.clientName)
+	}
+}
+
+// 删除过期的仲裁记录和最近消息，需要持有锁
+func (wss *WsServer) cleanContests(now time.Time) {
+	for trigger, contest := range wss.contests {
+		if contest.decided && now.After(contest.expire) {
+			delete(wss.contests, trigger)
+		}
+	}
+	for key, recent := range wss.recentMessages {
+		if now.Sub(recent.time) > seconds(CONFIG.Server.Arbitration.LinkTimeout) {
+			delete(wss.recentMessages, key)
+		}
+	}
+}
+
+// 仲裁失败的bot应用收到的响应
+func arbitrationLoserResponse(echo json.RawMessage) []byte {
+	arb := &CONFIG.Server.Arbitration
+	if arb.Loser == ARBITRATION_LOSER_FAILED {
+		return NewFailedResponse(arb.Retcode, arb.Message, echo)
+	}
+	resp, _ := json.Marshal(OneBotResponse{
+		Status:  "ok",
+		Retcode: 0,
+		Data:    map[string]any{"message_id": 0},
+		Echo:    echo,
+	})
+	return resp
+}
+
+// 会话的key，群聊为group:群号，私聊为private:QQ号
+func chatKey(messageType string, userId, groupId json.RawMessage) string {
+	switch messageType {
+	case GROUP:
+		if id := jsonId(groupId); id != "" {
+			return "group:" + id
+		}
+	case PRIVATE:
+		if id := jsonId(userId); id != "" {
+			return "private:" + id
+		}
+	}
+	return ""
+}
+
+// id可能是数字也可能是字符串，统一为字符串
+func jsonId(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String()
+	}
+	return ""
+}
+
+// 消息中回复消息段的id，支持array和字符串格式
+func replyId(message json.RawMessage) string {
+	var segments []MessageContent
+	var text string
+	if err := json.Unmarshal(message, &text); err == nil {
+		if !strings.Contains(text, "[CQ:reply,") {
+			return ""
+		}
+		segments = ParseCQString(text)
+	} else if err := json.Unmarshal(message, &segments); err != nil {
+		// 单个消息段
+		var segment MessageContent
+		if err := json.Unmarshal(message, &segment); err != nil {
+			return ""
+		}
+		segments = []MessageContent{segment}
+	}
+	for _, segment := range segments {
+		if segment.Type == "reply" {
+			id, _ := json.Marshal(segment.Data["id"])
+			return jsonId(id)
+		}
+	}
+	return ""
+}
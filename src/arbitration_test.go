@@ -0,0 +1,137 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestJsonId(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`123`, "123"},
+		{`"123"`, "123"},
+		{`1234567890123`, "1234567890123"},
+		{`null`, ""},
+		{`{}`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		if got := jsonId(json.RawMessage(tt.raw)); got != tt.want {
+			t.Errorf("jsonId(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestReplyId(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"array", `[{"type":"reply","data":{"id":"42"}},{"type":"text","data":{"text":"hi"}}]`, "42"},
+		{"数字id", `[{"type":"reply","data":{"id":42}}]`, "42"},
+		{"单个消息段", `{"type":"reply","data":{"id":"42"}}`, "42"},
+		{"CQ码", `"[CQ:reply,id=42]hi"`, "42"},
+		{"没有回复", `"hi"`, ""},
+		{"没有回复的array", `[{"type":"text","data":{"text":"hi"}}]`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyId(json.RawMessage(tt.message)); got != tt.want {
+				t.Errorf("replyId(%s) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatKey(t *testing.T) {
+	tests := []struct {
+		messageType     string
+		userId, groupId string
+		want            string
+	}{
+		{GROUP, `1`, `5`, "group:5"},
+		{PRIVATE, `1`, `5`, "private:1"},
+		{PRIVATE, `"1"`, ``, "private:1"},
+		{GROUP, `1`, ``, ""},
+		{"channel", `1`, `5`, ""},
+	}
+	for _, tt := range tests {
+		if got := chatKey(tt.messageType, json.RawMessage(tt.userId), json.RawMessage(tt.groupId)); got != tt.want {
+			t.Errorf("chatKey(%s, %s, %s) = %q, want %q", tt.messageType, tt.userId, tt.groupId, got, tt.want)
+		}
+	}
+}
+
+func TestArbitrate(t *testing.T) {
+	old := CONFIG.Server.Arbitration
+	t.Cleanup(func() { CONFIG.Server.Arbitration = old })
+	CONFIG.Server.Arbitration = ArbitrationConfig{Enable: true, Window: 0.05}
+	if err := CONFIG.Server.Arbitration.Check(); err != nil {
+		t.Fatal(err)
+	}
+	action := func(name, params string) *OneBotAction {
+		return &OneBotAction{Action: name, Params: json.RawMessage(params)}
+	}
+	wss := &WsServer{}
+	wss.recordMessage([]byte(`{"post_type":"message","message_type":"group","group_id":5,"user_id":1,"message_id":42}`))
+
+	// 窗口内的回复，优先级高的胜出
+	var wg sync.WaitGroup
+	results := map[string]bool{}
+	var mutex sync.Mutex
+	for name, priority := range map[string]int{"bot1": 0, "bot2": 5} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			win := wss.waitArbitration(name, priority, action("send_group_msg", `{"group_id":5,"message":"hi"}`))
+			mutex.Lock()
+			results[name] = win
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if results["bot1"] || !results["bot2"] {
+		t.Fatalf("仲裁结果 = %v，应该是bot2胜出", results)
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		action *OneBotAction
+		want   bool
+	}{
+		{"仲裁后用reply回复，胜出的可以发送", "bot2", action("send_msg", `{"group_id":5,"message":"[CQ:reply,id=42]again"}`), true},
+		{"仲裁后用reply回复，没有胜出的不能发送", "bot1", action("send_msg", `{"group_id":5,"message":[{"type":"reply","data":{"id":"42"}}]}`), false},
+		{"仲裁后没有reply的回复，没有胜出的不能发送", "bot1", action("send_group_msg", `{"group_id":5,"message":"hi"}`), false},
+		{"仲裁后没有reply的回复，胜出的可以发送", "bot2", action("send_group_msg", `{"group_id":5,"message":"hi"}`), true},
+		{"没有最近消息的会话不仲裁", "bot1", action("send_group_msg", `{"group_id":6,"message":"hi"}`), true},
+		{"不需要仲裁的动作", "bot1", action("delete_msg", `{"message_id":42}`), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wss.waitArbitration(tt.client, 0, tt.action); got != tt.want {
+				t.Errorf("waitArbitration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArbitrationLoserResponse(t *testing.T) {
+	old := CONFIG.Server.Arbitration
+	t.Cleanup(func() { CONFIG.Server.Arbitration = old })
+	CONFIG.Server.Arbitration = ArbitrationConfig{Enable: true}
+	if err := CONFIG.Server.Arbitration.Check(); err != nil {
+		t.Fatal(err)
+	}
+	var resp OneBotResponse
+	if err := json.Unmarshal(arbitrationLoserResponse(json.RawMessage(`"e1"`)), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "failed" || resp.Retcode != RETCODE_CONFLICT || string(resp.Echo) != `"e1"` {
+		t.Errorf("默认的仲裁失败响应 = %+v", resp)
+	}
+}
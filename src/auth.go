@@ -0,0 +1,88 @@
+package onebotfilter
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// 检查请求中的access token，支持Authorization请求头和access_token参数
+// 通过时返回0，否则返回应当响应的http状态码（缺少token为401，token错误为403）
+func CheckAccessToken(r *http.Request, token string) int {
+	if token == "" {
+		return 0
+	}
+	got := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		got = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer"))
+	}
+	if got == "" {
+		return http.StatusUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// 检查OneBot客户端的连接请求，依次检查来源ip和access token
+// 通过时返回0，否则返回应当响应的http状态码和原因
+func CheckOneBotRequest(r *http.Request) (int, string) {
+	if !isUnixRequest(r) && !CONFIG.Server.allowIp(r.RemoteAddr) {
+		return http.StatusForbidden, fmt.Sprintf("ip %s 不在server.allow-ips中", r.RemoteAddr)
+	}
+	if status := CheckAccessToken(r, CONFIG.Server.AccessToken); status != 0 {
+		return status, "access token验证失败"
+	}
+	return 0, ""
+}
+
+// 检查OneBot客户端连接请求的Origin，没有Origin请求头的请求（非浏览器）直接通过
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(CONFIG.Server.AllowedOrigins) == 0 {
+		return true
+	}
+	return slices.Contains(CONFIG.Server.AllowedOrigins, origin)
+}
+
+// 来源地址是否在server.allow-ips中，没有配置时都允许
+func (sc *ServerConfig) allowIp(remoteAddr string) bool {
+	if len(sc.allowNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range sc.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析ip或cidr
+func parseIpNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("无法解析的ip：%s", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
@@ -2,10 +2,11 @@ package onebotfilter
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,10 +14,22 @@ import (
 
 type WsClient struct {
 	Name      string
-	conn      *websocket.Conn
+	conn      *websocket.Conn // Universal连接，split-roles时为API连接
+	eventConn *websocket.Conn // split-roles时的Event连接，只用于发送事件
 	filter    *Filter
-	readChan  chan WsMsg //从bot应用端读取到的消息
-	writeChan chan WsMsg //写入到bot应用端的消息
+	readChan  chan WsMsg  //从bot应用端读取到的消息
+	writeChan chan WsMsg  //写入到bot应用端的消息
+	poster    *httpPoster // 不为nil时，使用http post发送事件，而不是ws
+	keepalive KeepaliveConfig
+	queue     *offlineQueue // 离线队列，为nil时没有启用
+	overflow  string        // 发送队列满时的处理方式
+	status    *BotAppStatus // 用于记录丢弃的消息数量
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	traffic   *traffic // 当前连接的流量统计
+	priority  int      // 回复仲裁时的优先级
+
+	closedOffline atomic.Bool // 因为offline-policy为disconnect被断开
 }
 
 // 连接到反向ws服务端，转发消息，并使用过滤器
@@ -28,78 +41,229 @@ func WsClientHandler(wss *WsServer, cfg BotAppsConfig) {
 		return
 	}
 	//onebot header
-	header := http.Header{}
-	header.Set("x-self-id", CONFIG.Server.BotId)
-	header.Set("authorization", fmt.Sprintf("Bearer %s", cfg.AccessToken))
-	header.Set("user-agent", CONFIG.Server.UserAgent)
-	header.Set("x-client-role", "Universal")
+	header := cfg.dialHeader(wss.SelfId)
+	tlsConfig, err := cfg.TLS.Build()
+	if err != nil {
+		log.Printf("%s的tls配置有问题: %v\n", cfg.Name, err)
+		return
+	}
 	//filter
-	filter := (&Filter{Name: cfg.Name}).Compile(cfg)
+	filter := (&Filter{Name: cfg.Name, SelfId: wss.SelfId}).Compile(cfg)
 	AddFilter(filter)
-	defer RemoveFilter(filter.Name)
+	defer RemoveFilter(filter.Name, filter.SelfId)
 	//client
+	status := wss.botAppStatus(cfg.Name)
+	retry := &backoff{cfg: cfg.Reconnect}
+	queue := wss.addOfflineQueue(cfg, filter)
 	for { //循环重连，转发消息
-		log.Printf("正在连接：%s\n", cfg.Name)
+		if wss.holdBotApps() {
+			status.set(STATE_WAITING, retry.attempts, nil, time.Time{})
+			select {
+			case <-wss.whenOnline():
+			case <-shutdownCtx.Done():
+				return
+			}
+		}
+		status.set(STATE_CONNECTING, retry.attempts, nil, time.Time{})
+		log.Printf("正在为账号%s连接：%s\n", wss.SelfId, cfg.Name)
 
 		dialer := &websocket.Dialer{
-			Proxy:            http.ProxyFromEnvironment,
-			HandshakeTimeout: 45 * time.Second,
-			ReadBufferSize:   CONFIG.Server.BufferSize,
-			WriteBufferSize:  CONFIG.Server.BufferSize,
+			Proxy:             cfg.proxyFunc(),
+			HandshakeTimeout:  45 * time.Second,
+			ReadBufferSize:    CONFIG.Server.BufferSize,
+			WriteBufferSize:   CONFIG.Server.BufferSize,
+			TLSClientConfig:   tlsConfig,
+			EnableCompression: cfg.Compression.Enable,
 		}
-		conn, _, err := dialer.Dial(cfg.Uri, header)
+		// API和Event连接一起统计流量
+		conn, eventConn, err := dialBotApp(dialer, &traffic{}, cfg, header)
 		if err != nil {
 			log.Printf("连接%s异常: %v\n", cfg.Name, err)
-			time.Sleep(time.Duration(CONFIG.Server.SleepTime) * time.Second)
+			if !waitReconnect(cfg.Name, status, retry, err) {
+				return
+			}
 			continue
 		}
-		client := &WsClient{
-			Name:      cfg.Name,
-			conn:      conn,
-			filter:    filter,
-			readChan:  make(chan WsMsg),
-			writeChan: make(chan WsMsg),
-		}
+		client := newWsClient(cfg, conn, filter)
+		client.eventConn = eventConn
+		cfg.Compression.apply(eventConn)
+		client.queue = queue
 		err = wss.AddWsClient(client) //添加到客户端列表
 		if err != nil {
 			log.Printf("连接%s异常: %v\n", cfg.Name, err)
-			client.conn.Close()
-			time.Sleep(time.Duration(CONFIG.Server.SleepTime) * time.Second)
+			client.closeConn()
+			if !waitReconnect(cfg.Name, status, retry, err) {
+				return
+			}
+			continue
+		}
+		retry.reset()
+		status.set(STATE_CONNECTED, 0, nil, time.Time{})
+		log.Printf("账号%s已连接到：%s，加载的过滤器：%s\n", wss.SelfId, cfg.Name, filter.String())
+		err = client.serve(wss)
+		log.Printf("从%s读取消息出错：%v\n", cfg.Name, err)
+		if client.closedOffline.Load() && !shuttingDown() {
+			// 由offline-policy断开的，等OneBot客户端重新连接后立即连接，OneBot客户端已经重新连接时也不需要等待
+			retry.reset()
 			continue
 		}
-		ctx, ctxCancel := context.WithCancel(context.Background())
-		go client.readLoop(ctx, wss)
-		go client.writeLoop(ctx)
-		log.Printf("已连接到：%s，加载的过滤器：%s\n", cfg.Name, filter.String())
-		for {
-			mt, msg, err := client.conn.ReadMessage()
-			if err != nil {
-				log.Printf("从%s读取消息出错：%v\n", cfg.Name, err)
-				client.conn.Close()             //关闭客户端
-				wss.RemoveWsClient(client.Name) //从客户端列表中删除
-				time.Sleep(5 * time.Second)
-				break
+		if !waitReconnect(cfg.Name, status, retry, err) {
+			return
+		}
+	}
+}
+
+// 按照重新连接策略等待，超过最大重新连接次数时返回false
+func waitReconnect(name string, status *BotAppStatus, retry *backoff, err error) bool {
+	if shuttingDown() {
+		return false
+	}
+	delay, ok := retry.next()
+	if !ok {
+		status.set(STATE_GIVEN_UP, retry.attempts, err, time.Time{})
+		log.Printf("%s已经连续重新连接%d次，不再重新连接\n", name, retry.cfg.MaxAttempts)
+		return false
+	}
+	status.set(STATE_BACKING_OFF, retry.attempts, err, time.Now().Add(delay))
+	log.Printf("%s将在%.1f秒后重新连接\n", name, delay.Seconds())
+	return sleepUnlessShutdown(delay)
+}
+
+// 连接bot应用，split-roles时分别建立API和Event两个连接
+func dialBotApp(dialer *websocket.Dialer, t *traffic, cfg BotAppsConfig, header http.Header) (conn, eventConn *websocket.Conn, err error) {
+	if !cfg.SplitRoles {
+		conn, err = dialWs(*dialer, t, cfg, cfg.Uri, header)
+		return conn, nil, err
+	}
+	apiHeader := header.Clone()
+	apiHeader.Set("x-client-role", "API")
+	conn, err = dialWs(*dialer, t, cfg, cfg.ApiUri, apiHeader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("API连接：%w", err)
+	}
+	eventHeader := header.Clone()
+	eventHeader.Set("x-client-role", "Event")
+	eventConn, err = dialWs(*dialer, t, cfg, cfg.EventUri, eventHeader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Event连接：%w", err)
+	}
+	return conn, eventConn, nil
+}
+
+// 连接一个ws地址，unix://地址连接对应的unix socket
+func dialWs(dialer websocket.Dialer, t *traffic, cfg BotAppsConfig, uri string, header http.Header) (*websocket.Conn, error) {
+	sock, uri, err := parseUnixUri(uri, "ws")
+	if err != nil {
+		return nil, err
+	}
+	if sock != "" {
+		dialer.Proxy = nil
+	}
+	dialer.NetDialContext = t.dialFunc(sock)
+	conn, _, err := dialer.Dial(cfg.dialUri(uri), header)
+	return conn, err
+}
+
+func newWsClient(cfg BotAppsConfig, conn *websocket.Conn, filter *Filter) *WsClient {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	// http post没有ws连接，只统计消息内容
+	t := &traffic{}
+	if conn != nil {
+		cfg.Compression.apply(conn)
+		t = trafficOf(conn)
+	}
+	return &WsClient{
+		Name:      cfg.Name,
+		keepalive: cfg.Keepalive,
+		conn:      conn,
+		filter:    filter,
+		readChan:  make(chan WsMsg),
+		writeChan: make(chan WsMsg, cfg.DeliveryQueue.Size),
+		overflow:  cfg.DeliveryQueue.Overflow,
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+		traffic:   t,
+		priority:  cfg.Priority,
+	}
+}
+
+// 转发已经添加到客户端列表的bot应用端的消息，直到连接断开
+func (wc *WsClient) serve(wss *WsServer) error {
+	ctx := wc.ctx
+	go wc.readLoop(ctx, wss)
+	go wc.writeLoop(ctx)
+	defer wc.close()
+	startKeepalive(ctx, wc.conn, wc.keepalive)
+	// 先发送connect，再补发离线期间的事件
+	wss.greetClient(wc)
+	if wc.queue != nil {
+		wc.queue.goOnline(wc)
+	}
+	if wc.eventConn != nil {
+		startKeepalive(ctx, wc.eventConn, wc.keepalive)
+		// Event连接不接收动作请求，只需要在它断开时一起断开API连接
+		go func(eventConn *websocket.Conn) {
+			for {
+				if _, _, err := eventConn.ReadMessage(); err != nil {
+					wc.conn.Close()
+					return
+				}
+				extendReadDeadline(eventConn, wc.keepalive)
+			}
+		}(wc.eventConn)
+	}
+	for {
+		mt, msg, err := wc.conn.ReadMessage()
+		if err != nil {
+			if wc.queue != nil {
+				wc.queue.goOffline(wc)
 			}
-			client.readChan <- WsMsg{mt, msg}
+			wc.closeConn()              //关闭客户端
+			wss.RemoveWsClient(wc.Name) //从客户端列表中删除
+			return err
 		}
-		client.close(ctxCancel)
+		extendReadDeadline(wc.conn, wc.keepalive)
+		wc.traffic.payloadIn.Add(uint64(len(msg)))
+		wc.readChan <- WsMsg{MsgType: mt, MsgData: msg}
 	}
 }
+
 func (wc *WsClient) WriteMessage(mt int, msg []byte) error {
-	if wc.conn == nil {
-		return errors.New("没有连接到bot应用端")
+	return wc.push(WsMsg{MsgType: mt, MsgData: msg}, false)
+}
+
+// 发送动作响应，不受overflow影响，等待发送队列有空位
+func (wc *WsClient) writeResponse(resp []byte) error {
+	return wc.push(WsMsg{MsgType: websocket.TextMessage, MsgData: resp, Filtered: true, Response: true}, true)
+}
+
+// 回复失败的动作响应
+func (wc *WsClient) replyFailed(retcode int, message string, echo json.RawMessage) {
+	if err := wc.writeResponse(NewFailedResponse(retcode, message, echo)); err != nil {
+		log.Printf("向%s发送消息出错：%v\n", wc.Name, err)
 	}
-	wc.writeChan <- WsMsg{mt, msg}
-	return nil
 }
-func (wc *WsClient) close(ctxCancel context.CancelFunc) {
-	ctxCancel()
+
+// 发送已经使用过滤器处理过的消息
+func (wc *WsClient) writeFiltered(mt int, msg []byte) error {
+	return wc.push(WsMsg{MsgType: mt, MsgData: msg, Filtered: true}, false)
+}
+
+// 通道不会关闭，避免向已关闭的通道写入，发送方通过ctx得知连接已断开
+func (wc *WsClient) close() {
+	wc.ctxCancel()
+	wc.closeConn()
+}
+
+// 关闭与bot应用端的连接
+func (wc *WsClient) closeConn() {
 	if wc.conn != nil {
 		wc.conn.Close()
 	}
-	close(wc.readChan)
-	close(wc.writeChan)
-	wc.conn = nil
+	if wc.eventConn != nil {
+		wc.eventConn.Close()
+	}
 }
 
 // 处理从bot应用端读取的消息
@@ -107,10 +271,25 @@ func (wc *WsClient) readLoop(ctx context.Context, wss *WsServer) {
 	for {
 		select {
 		case msg := <-wc.readChan:
-			//转发给OneBot客户端
-			if err := wss.WriteMessage(msg.MsgType, msg.MsgData); err != nil {
-				log.Println("写入到OneBot客户端出错：", err)
+			var action *OneBotAction
+			if msg.MsgType == websocket.TextMessage {
+				action = ParseOneBotAction(msg.MsgData)
+			}
+			// 检查是否允许此动作
+			if action != nil && !wc.filter.Actions.Filter(action.Action) {
+				log.Printf("%s：不允许的动作：%s\n", wc.Name, action.Action)
+				wc.replyFailed(RETCODE_FORBIDDEN, "不允许的动作："+action.Action, action.Echo)
+				continue
 			}
+			// 多个bot应用回复同一条消息时，等待仲裁后再发送
+			// 在这里等待，这个bot应用之后的动作排在后面，保持动作的顺序
+			if action != nil && !wss.waitArbitration(wc.Name, wc.priority, action) {
+				if err := wc.writeResponse(arbitrationLoserResponse(action.Echo)); err != nil {
+					log.Printf("向%s发送消息出错：%v\n", wc.Name, err)
+				}
+				continue
+			}
+			wc.sendAction(wss, msg, action)
 		case <-ctx.Done():
 			return
 
@@ -118,39 +297,73 @@ func (wc *WsClient) readLoop(ctx context.Context, wss *WsServer) {
 	}
 }
 
+// 把动作请求转发给OneBot客户端
+func (wc *WsClient) sendAction(wss *WsServer, msg WsMsg, action *OneBotAction) {
+	if err := wss.SendAction(wc.Name, msg.MsgType, msg.MsgData); err != nil {
+		log.Println("写入到OneBot客户端出错：", err)
+		// 由本程序回复失败的响应，避免bot应用一直等待
+		if action != nil {
+			wc.replyFailed(RETCODE_OFFLINE, err.Error(), action.Echo)
+		}
+	}
+}
+
 // 处理发送给bot应用端的消息
 func (wc *WsClient) writeLoop(ctx context.Context) {
 	for {
 		select {
 		case msg := <-wc.writeChan:
-			if msg.MsgType == websocket.TextMessage {
-
-				// 解析onebot的消息
-				onebotMessage := ParseOneBotMessage(msg.MsgData)
-				if onebotMessage == nil {
-					//解析出错的消息也直接放行
-					if err := wc.conn.WriteMessage(msg.MsgType, msg.MsgData); err != nil {
-						log.Printf("向%s发送消息出错：%v\n", wc.Name, err)
-					}
-					continue
-				}
-				// 通常的消息
-				if onebotMessage.Partial.RawMessage != "" {
-					if wc.filter.Filter(onebotMessage) {
-						//过滤器通过，发送
-						if err := wc.conn.WriteJSON(onebotMessage.Intact); err != nil {
-							log.Printf("向%s发送消息出错：%v\n", wc.Name, err)
-						}
-					}
+			// 关闭帧排在队列最后，之前的消息都已经发送
+			if msg.MsgType == websocket.CloseMessage {
+				wc.sendClose(msg.MsgData)
+				continue
+			}
+			data := msg.MsgData
+			if !msg.Filtered {
+				var ok bool
+				if data, ok = wc.filter.FilterMessage(msg); !ok {
 					continue
 				}
 			}
-			//其他消息直接放行
-			if err := wc.conn.WriteMessage(msg.MsgType, msg.MsgData); err != nil {
+			if err := wc.send(msg.MsgType, data); err != nil {
 				log.Printf("向%s发送消息出错：%v\n", wc.Name, err)
+				// ws写入出错后连接已经不可用，关闭连接使其重新连接
+				if wc.poster == nil {
+					wc.closeConn()
+				}
+				continue
 			}
+			wc.traffic.payloadOut.Add(uint64(len(data)))
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// 把消息发送到bot应用端
+func (wc *WsClient) send(mt int, data []byte) error {
+	if wc.poster != nil {
+		return wc.poster.post(data)
+	}
+	if wc.eventConn != nil && isEvent(data) {
+		return writeWithDeadline(wc.eventConn, wc.keepalive, mt, data)
+	}
+	return writeWithDeadline(wc.conn, wc.keepalive, mt, data)
+}
+
+// 发送关闭帧，等待bot应用端关闭连接，http post没有连接，直接结束
+func (wc *WsClient) sendClose(data []byte) {
+	if wc.poster != nil {
+		wc.ctxCancel()
+		return
+	}
+	for _, conn := range []*websocket.Conn{wc.eventConn, wc.conn} {
+		if conn == nil {
+			continue
+		}
+		if err := writeWithDeadline(conn, wc.keepalive, websocket.CloseMessage, data); err != nil {
+			wc.closeConn()
+			return
+		}
+	}
+}
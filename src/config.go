@@ -3,8 +3,13 @@ package onebotfilter
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
+	"slices"
+	"strings"
 
+	regexp "github.com/dlclark/regexp2"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
@@ -54,31 +59,191 @@ func (c *Config) Check() (err error) {
 	for _, bac := range c.BotApps {
 		err = errors.Join(err, bac.Check())
 	}
+	// 路由规则的目标需要是配置过的bot应用
+	for _, route := range c.Server.Routes {
+		for _, target := range route.Targets {
+			if !slices.ContainsFunc(c.BotApps, func(bac BotAppsConfig) bool { return bac.Name == target }) {
+				err = errors.Join(err, fmt.Errorf("server.routes.%s.targets中的%s不是配置过的bot应用", route.Name, target))
+			}
+		}
+	}
 	return
 }
 
 type ServerConfig struct {
-	Host      string `mapstructure:"host" yaml:"host"`
-	Port      uint   `mapstructure:"port" yaml:"port"`
-	Suffix    string `mapstructure:"suffix" yaml:"suffix"`
-	BotId     string `mapstructure:"bot-id" yaml:"bot-id"`
-	UserAgent string `mapstructure:"user-agent" yaml:"user-agent"`
-	Default   struct {
+	Host       string           `mapstructure:"host" yaml:"host"`
+	Port       uint             `mapstructure:"port" yaml:"port"`
+	UnixSocket UnixSocketConfig `mapstructure:"unix-socket" yaml:"unix-socket"` //不为空时，同时在这个unix socket上监听；port为0时只监听unix socket
+	Suffix     string           `mapstructure:"suffix" yaml:"suffix"`
+	Mode       string           `mapstructure:"mode" yaml:"mode"` // reverse or forward
+	Forward    []ForwardConfig  `mapstructure:"forward" yaml:"forward"`
+	BotId      string           `mapstructure:"bot-id" yaml:"bot-id"` //默认账号，OneBot客户端没有发送x-self-id时使用
+	UserAgent  string           `mapstructure:"user-agent" yaml:"user-agent"`
+	Default    struct {
 		UserId  IdConfig `mapstructure:"user-id" yaml:"user-id"`
 		GroupId IdConfig `mapstructure:"group-id" yaml:"group-id"`
 	} `mapstructure:"default" yaml:"default"`
-	BufferSize int     `mapstructure:"buffer-size" yaml:"buffer-size"`
-	SleepTime  float32 `mapstructure:"sleep-time" yaml:"sleep-time"` //重新连接的间隔，单位秒
-	Debug      bool    `mapstructure:"debug" yaml:"debug"`
+	AccessToken     string   `mapstructure:"access-token" yaml:"access-token"`       //OneBot客户端连接本程序时使用的access token
+	AllowIps        []string `mapstructure:"allow-ips" yaml:"allow-ips"`             //允许连接本程序的OneBot客户端ip或cidr，为空时不限制
+	AllowedOrigins  []string `mapstructure:"allowed-origins" yaml:"allowed-origins"` //允许的Origin请求头，为空时不限制
+	allowNets       []*net.IPNet
+	TLS             TLSServerConfig   `mapstructure:"tls" yaml:"tls"` //配置证书后，使用wss和https
+	BufferSize      int               `mapstructure:"buffer-size" yaml:"buffer-size"`
+	SleepTime       float32           `mapstructure:"sleep-time" yaml:"sleep-time"`             //重新连接的间隔，单位秒，默认为5
+	Keepalive       KeepaliveConfig   `mapstructure:"keepalive" yaml:"keepalive"`               //与OneBot客户端连接的保活配置，也是bot应用keepalive的默认值
+	ActionTimeout   float64           `mapstructure:"action-timeout" yaml:"action-timeout"`     //等待OneBot客户端响应动作请求的超时时间，单位秒，超时后回复失败的响应，默认为30
+	MetaEvent       MetaEventConfig   `mapstructure:"meta-event" yaml:"meta-event"`             //由本程序生成发给bot应用的元事件
+	OfflinePolicy   string            `mapstructure:"offline-policy" yaml:"offline-policy"`     //OneBot客户端断开时对bot应用的处理方式：hold、disable或disconnect，默认为hold
+	Routes          []RouteConfig     `mapstructure:"routes" yaml:"routes"`                     //独占路由规则，按顺序匹配，匹配的消息只发给一个bot应用
+	Arbitration     ArbitrationConfig `mapstructure:"arbitration" yaml:"arbitration"`           //多个bot应用回复同一条消息时，只发送优先级最高的回复
+	Compression     CompressionConfig `mapstructure:"compression" yaml:"compression"`           //与OneBot客户端连接的permessage-deflate压缩
+	ShutdownTimeout float64           `mapstructure:"shutdown-timeout" yaml:"shutdown-timeout"` //收到退出信号后，等待消息发送完毕和连接关闭的最长时间，单位秒，默认为10
+	StatusPath      string            `mapstructure:"status-path" yaml:"status-path"`           //不为空时，在这个路径上以json提供各个账号和bot应用的状态
+	Debug           bool              `mapstructure:"debug" yaml:"debug"`
+}
+
+// 独占路由规则，条件都满足时匹配，没有配置的条件不检查
+type RouteConfig struct {
+	Name        string   `mapstructure:"name" yaml:"name"`                 //规则的名字，用于日志
+	MessageType string   `mapstructure:"message-type" yaml:"message-type"` //private或group，为空时都匹配
+	Prefix      []string `mapstructure:"prefix" yaml:"prefix"`             //消息以其中一个前缀开头，与regex满足一个即可
+	Regex       []string `mapstructure:"regex" yaml:"regex"`               //消息匹配其中一个正则表达式
+	GroupId     []int64  `mapstructure:"group-id" yaml:"group-id"`         //群号在其中
+	UserId      []int64  `mapstructure:"user-id" yaml:"user-id"`           //QQ号在其中
+	Targets     []string `mapstructure:"targets" yaml:"targets"`           //接收消息的bot应用，依次尝试，发给第一个在线的
+	regexps     []*regexp.Regexp
 }
+
+func (rc *RouteConfig) Check() error {
+	if rc.Name == "" {
+		rc.Name = strings.Join(rc.Targets, ",")
+	}
+	if len(rc.Targets) == 0 {
+		return fmt.Errorf("routes.%s.targets不能为空", rc.Name)
+	}
+	switch rc.MessageType {
+	case "", PRIVATE, GROUP:
+		// ok
+	default:
+		return fmt.Errorf("routes.%s.message-type只能是private或group", rc.Name)
+	}
+	if rc.MessageType == "" && len(rc.Prefix) == 0 && len(rc.Regex) == 0 && len(rc.GroupId) == 0 && len(rc.UserId) == 0 {
+		return fmt.Errorf("routes.%s至少需要一个条件", rc.Name)
+	}
+	rc.regexps = nil
+	for _, s := range rc.Regex {
+		pattern, err := regexp.Compile(s, regexp.None)
+		if err != nil {
+			return fmt.Errorf("routes.%s.regex：编译正则表达式%s出错：%v", rc.Name, s, err)
+		}
+		rc.regexps = append(rc.regexps, pattern)
+	}
+	return nil
+}
+
+// 回复仲裁配置
+type ArbitrationConfig struct {
+	Enable      bool     `mapstructure:"enable" yaml:"enable"`
+	Window      float64  `mapstructure:"window" yaml:"window"`             //收到第一个回复后等待其他回复的秒数，默认为1
+	LinkTimeout float64  `mapstructure:"link-timeout" yaml:"link-timeout"` //没有回复消息段时，回复关联到这么多秒内同一会话的最后一条消息，默认为30
+	Actions     []string `mapstructure:"actions" yaml:"actions"`           //需要仲裁的动作，默认为send_msg、send_group_msg和send_private_msg
+	Loser       string   `mapstructure:"loser" yaml:"loser"`               //没有胜出的bot应用收到的响应：failed或ok，默认为failed
+	Retcode     int      `mapstructure:"retcode" yaml:"retcode"`           //loser为failed时的retcode，默认为1409
+	Message     string   `mapstructure:"message" yaml:"message"`           //loser为failed时的message
+}
+
+func (ac *ArbitrationConfig) Check() error {
+	if !ac.Enable {
+		return nil
+	}
+	if ac.Window < 0 || ac.LinkTimeout < 0 {
+		return errors.New("arbitration.window和arbitration.link-timeout不能小于0")
+	}
+	if ac.Window == 0 {
+		ac.Window = 1
+	}
+	if ac.LinkTimeout == 0 {
+		ac.LinkTimeout = 30
+	}
+	if len(ac.Actions) == 0 {
+		ac.Actions = []string{"send_msg", "send_group_msg", "send_private_msg"}
+	}
+	switch ac.Loser {
+	case "":
+		ac.Loser = ARBITRATION_LOSER_FAILED
+	case ARBITRATION_LOSER_OK, ARBITRATION_LOSER_FAILED:
+		// ok
+	default:
+		return errors.New("arbitration.loser只能是ok或failed")
+	}
+	if ac.Retcode == 0 {
+		ac.Retcode = RETCODE_CONFLICT
+	}
+	if ac.Message == "" {
+		ac.Message = "其他bot应用已经回复了这条消息"
+	}
+	return nil
+}
+
+// 在unix socket上监听
+type UnixSocketConfig struct {
+	Path     string `mapstructure:"path" yaml:"path"` //socket文件路径
+	Mode     string `mapstructure:"mode" yaml:"mode"` //socket文件的权限，八进制，默认为0660
+	fileMode fs.FileMode
+}
+
+// 正向ws模式下，要连接的OneBot客户端
+type ForwardConfig struct {
+	Uri         string          `mapstructure:"uri" yaml:"uri"`
+	AccessToken string          `mapstructure:"access-token" yaml:"access-token"`
+	SelfId      string          `mapstructure:"self-id" yaml:"self-id"` //为空时使用server.bot-id
+	TLS         TLSClientConfig `mapstructure:"tls" yaml:"tls"`
+}
+
+// 本程序监听时使用的证书
+type TLSServerConfig struct {
+	CertFile string `mapstructure:"cert-file" yaml:"cert-file"`
+	KeyFile  string `mapstructure:"key-file" yaml:"key-file"`
+}
+
+// 作为客户端连接wss或https时的tls配置
+type TLSClientConfig struct {
+	CaFile     string `mapstructure:"ca-file" yaml:"ca-file"`         //自定义的CA证书
+	CertFile   string `mapstructure:"cert-file" yaml:"cert-file"`     //mTLS使用的客户端证书
+	KeyFile    string `mapstructure:"key-file" yaml:"key-file"`       //mTLS使用的客户端私钥
+	ServerName string `mapstructure:"server-name" yaml:"server-name"` //校验证书时使用的域名，为空时使用uri中的域名
+}
+
 type BotAppsConfig struct {
-	Name           string        `mapstructure:"name" yaml:"name"`
-	Uri            string        `mapstructure:"uri" yaml:"uri"`
-	AccessToken    string        `mapstructure:"access-token" yaml:"access-token"`
-	UserId         IdConfig      `mapstructure:"user-id" yaml:"user-id"`
-	GroupId        IdConfig      `mapstructure:"group-id" yaml:"group-id"`
-	PrivateMessage MessageConfig `mapstructure:"private-message" yaml:"private-message"`
-	GroupMessage   MessageConfig `mapstructure:"group-message" yaml:"group-message"`
+	Name           string              `mapstructure:"name" yaml:"name"`
+	Type           string              `mapstructure:"type" yaml:"type"` // ws or http-post
+	Uri            string              `mapstructure:"uri" yaml:"uri"`
+	SplitRoles     bool                `mapstructure:"split-roles" yaml:"split-roles"`       //为true时，分别建立Event和API两个反向ws连接
+	EventUri       string              `mapstructure:"event-uri" yaml:"event-uri"`           //split-roles时Event连接的地址，为空时使用uri
+	ApiUri         string              `mapstructure:"api-uri" yaml:"api-uri"`               //split-roles时API连接的地址，为空时使用uri
+	ListenPath     string              `mapstructure:"listen-path" yaml:"listen-path"`       //不为空时，由bot应用连接本程序的这个路径，不再连接uri
+	HttpApi        string              `mapstructure:"http-api" yaml:"http-api"`             //不为空时，在这个路径下为bot应用提供http api
+	Actions        ActionConfig        `mapstructure:"actions" yaml:"actions"`               //允许bot应用调用的动作
+	HttpPost       HttpPostConfig      `mapstructure:"http-post" yaml:"http-post"`           //type为http-post时的配置
+	TLS            TLSClientConfig     `mapstructure:"tls" yaml:"tls"`                       //连接wss或https的bot应用时的tls配置
+	Reconnect      ReconnectConfig     `mapstructure:"reconnect" yaml:"reconnect"`           //重新连接策略
+	Keepalive      KeepaliveConfig     `mapstructure:"keepalive" yaml:"keepalive"`           //保活配置，不填写时使用server.keepalive
+	Compression    CompressionConfig   `mapstructure:"compression" yaml:"compression"`       //与bot应用连接的permessage-deflate压缩
+	OfflineQueue   OfflineQueueConfig  `mapstructure:"offline-queue" yaml:"offline-queue"`   //bot应用断开期间保存事件，重新连接后补发
+	DeliveryQueue  DeliveryQueueConfig `mapstructure:"delivery-queue" yaml:"delivery-queue"` //发送给bot应用的消息队列
+	Priority       int                 `mapstructure:"priority" yaml:"priority"`             //回复仲裁时的优先级，越大越优先，默认为0
+	AccessToken    string              `mapstructure:"access-token" yaml:"access-token"`
+	TokenInQuery   bool                `mapstructure:"token-in-query" yaml:"token-in-query"` //为true时，access-token放在uri的access_token参数中，不使用Authorization请求头
+	Proxy          string              `mapstructure:"proxy" yaml:"proxy"`                   //连接bot应用使用的代理，支持http和socks5，为空时使用环境变量中的代理
+	Headers        map[string]string   `mapstructure:"headers" yaml:"headers"`               //连接bot应用时额外添加的请求头
+	SelfIds        []string            `mapstructure:"self-ids" yaml:"self-ids"`             //为哪些账号连接此bot应用，为空时为所有账号连接
+	UserId         IdConfig            `mapstructure:"user-id" yaml:"user-id"`
+	GroupId        IdConfig            `mapstructure:"group-id" yaml:"group-id"`
+	PrivateMessage MessageConfig       `mapstructure:"private-message" yaml:"private-message"`
+	GroupMessage   MessageConfig       `mapstructure:"group-message" yaml:"group-message"`
+	Notice         EventConfig         `mapstructure:"notice" yaml:"notice"`       //通知事件过滤器
+	Request        EventConfig         `mapstructure:"request" yaml:"request"`     //请求事件过滤器
+	Subscribe      []string            `mapstructure:"subscribe" yaml:"subscribe"` //订阅的事件，格式为post_type或post_type.类型，为空时订阅所有事件
 	// 保留顶层 message 以向后兼容历史版本的配置
 	//若 private/group 未单独配置 message，则使用此项
 	Message MessageConfig `mapstructure:"message" yaml:"message"`
@@ -89,11 +254,114 @@ type IdConfig struct {
 	Ids  []int64 `mapstructure:"ids" yaml:"ids"`
 }
 
+// 由本程序生成的元事件
+type MetaEventConfig struct {
+	Lifecycle         bool    `mapstructure:"lifecycle" yaml:"lifecycle"`                   //为true时，bot应用连接时发送connect，OneBot客户端连接或断开时发送enable或disable
+	HeartbeatInterval float64 `mapstructure:"heartbeat-interval" yaml:"heartbeat-interval"` //不为0时，按这个间隔（秒）发送心跳事件
+}
+
+// ws连接的保活配置，单位都是秒，为0时不启用
+type KeepaliveConfig struct {
+	PingInterval float64 `mapstructure:"ping-interval" yaml:"ping-interval"` //发送ping的间隔
+	PongTimeout  float64 `mapstructure:"pong-timeout" yaml:"pong-timeout"`   //发送ping后，超过ping-interval+pong-timeout没有收到任何消息就断开
+	ReadTimeout  float64 `mapstructure:"read-timeout" yaml:"read-timeout"`   //超过这个时间没有收到任何消息就断开，会覆盖ping-interval+pong-timeout
+	WriteTimeout float64 `mapstructure:"write-timeout" yaml:"write-timeout"` //写入消息的超时时间
+}
+
+// permessage-deflate压缩配置
+type CompressionConfig struct {
+	Enable bool `mapstructure:"enable" yaml:"enable"` //是否协商启用压缩，对方不支持时不压缩
+	Level  int  `mapstructure:"level" yaml:"level"`   //压缩等级，-2到9，默认为1（最快）
+}
+
+func (cc *CompressionConfig) Check() error {
+	if cc.Level == 0 {
+		cc.Level = 1
+	}
+	if cc.Level < -2 || cc.Level > 9 {
+		return errors.New("compression.level只能在-2到9之间")
+	}
+	return nil
+}
+
+// 发送队列配置
+type DeliveryQueueConfig struct {
+	Size     int    `mapstructure:"size" yaml:"size"`         //队列长度，默认为1000
+	Overflow string `mapstructure:"overflow" yaml:"overflow"` //队列满时的处理方式：block、drop-oldest、drop-newest或disconnect，默认为drop-oldest
+}
+
+// 离线队列配置
+type OfflineQueueConfig struct {
+	MaxSize   int      `mapstructure:"max-size" yaml:"max-size"`     //最多保存的事件数量，超过时丢弃最早的事件，为0时不启用
+	Ttl       float64  `mapstructure:"ttl" yaml:"ttl"`               //事件保存的时间，单位秒，为0时不限制
+	PostTypes []string `mapstructure:"post-types" yaml:"post-types"` //保存哪些post_type的事件，默认为message、notice、request
+}
+
+// 重新连接策略，每次重新连接的等待时间为上一次的multiplier倍
+type ReconnectConfig struct {
+	InitialDelay float64 `mapstructure:"initial-delay" yaml:"initial-delay"` //第一次重新连接前等待的时间，单位秒，默认为server.sleep-time
+	Multiplier   float64 `mapstructure:"multiplier" yaml:"multiplier"`       //默认为2
+	MaxDelay     float64 `mapstructure:"max-delay" yaml:"max-delay"`         //最长等待时间，单位秒，默认为60
+	Jitter       float64 `mapstructure:"jitter" yaml:"jitter"`               //随机浮动的比例，0到1之间
+	MaxAttempts  int     `mapstructure:"max-attempts" yaml:"max-attempts"`   //最多连续重新连接的次数，为0时不限制
+}
+
+type HttpPostConfig struct {
+	Secret  string  `mapstructure:"secret" yaml:"secret"`   //不为空时，使用HMAC-SHA1签名，放在X-Signature请求头中
+	Timeout float32 `mapstructure:"timeout" yaml:"timeout"` //上报超时时间，单位秒
+	Retries int     `mapstructure:"retries" yaml:"retries"` //上报失败时的重试次数
+	// 第一次重试前等待的秒数，之后每次翻倍，默认为1
+	RetryInterval float64 `mapstructure:"retry-interval" yaml:"retry-interval"`
+}
+
+type ActionConfig struct {
+	Mode    string   `mapstructure:"mode" yaml:"mode"` // on、whitelist or blacklist
+	Actions []string `mapstructure:"actions" yaml:"actions"`
+}
+
 type MessageConfig struct {
-	Mode          string   `mapstructure:"mode" yaml:"mode"` // on、whitelist or blacklist
-	Filters       []string `mapstructure:"filters" yaml:"filters"`
-	Prefix        []string `mapstructure:"prefix" yaml:"prefix"`
-	PrefixReplace string   `mapstructure:"prefix-replace" yaml:"prefix-replace"`
+	Mode          string        `mapstructure:"mode" yaml:"mode"` // on、whitelist or blacklist
+	Filters       []string      `mapstructure:"filters" yaml:"filters"`
+	Prefix        []string      `mapstructure:"prefix" yaml:"prefix"`
+	PrefixReplace string        `mapstructure:"prefix-replace" yaml:"prefix-replace"`
+	Segments      SegmentConfig `mapstructure:"segments" yaml:"segments"` //按消息段类型过滤，在mode之前检查
+}
+
+// 消息段过滤器
+type SegmentConfig struct {
+	Require []SegmentRule `mapstructure:"require" yaml:"require"` //消息至少包含其中一个消息段才能通过
+	Block   []SegmentRule `mapstructure:"block" yaml:"block"`     //包含其中任何一个消息段的消息不通过
+}
+
+// 匹配一种消息段，data中的每一项都要与消息段的数据相等，值为self时匹配bot自己的账号
+type SegmentRule struct {
+	Type string            `mapstructure:"type" yaml:"type"`
+	Data map[string]string `mapstructure:"data" yaml:"data"`
+}
+
+func (sc *SegmentConfig) Check() error {
+	for _, rule := range append(slices.Clone(sc.Require), sc.Block...) {
+		if rule.Type == "" {
+			return errors.New("segments中的type不能为空")
+		}
+	}
+	return nil
+}
+
+// 通知和请求事件过滤器
+type EventConfig struct {
+	Mode  string   `mapstructure:"mode" yaml:"mode"`   // on、off、whitelist or blacklist，不填写时不过滤
+	Types []string `mapstructure:"types" yaml:"types"` // notice_type或request_type，也可以写成type.sub_type，例如notify.poke
+}
+
+func (ec *EventConfig) Check() error {
+	switch ec.Mode {
+	case "", ON, OFF, WHITELIST, BLACKLIST:
+		// ok
+	default:
+		return errors.New("mode配置错误，只能是 on、off、whitelist 或 blacklist")
+	}
+	return nil
 }
 
 func (sc *ServerConfig) Check() error {
@@ -101,15 +369,100 @@ func (sc *ServerConfig) Check() error {
 	if sc.Host == "" {
 		return errors.New("server.host不能为空")
 	}
-	if sc.Port == 0 {
+	if sc.Port == 0 && sc.UnixSocket.Path == "" {
 		return errors.New("server.port不能为0")
 	}
-	if sc.BotId == "" {
-		return errors.New("server.bot-id不能为空")
+	if sc.UnixSocket.Path != "" {
+		if sc.UnixSocket.Mode == "" {
+			sc.UnixSocket.Mode = "0660"
+		}
+		mode, err := parseFileMode(sc.UnixSocket.Mode)
+		if err != nil {
+			return fmt.Errorf("server.unix-socket.mode：%v", err)
+		}
+		sc.UnixSocket.fileMode = mode
 	}
 	if sc.UserAgent == "" {
 		return errors.New("server.user-agent不能为空")
 	}
+	if (sc.TLS.CertFile == "") != (sc.TLS.KeyFile == "") {
+		return errors.New("server.tls.cert-file和server.tls.key-file需要同时配置")
+	}
+	if sc.MetaEvent.HeartbeatInterval < 0 {
+		return errors.New("server.meta-event.heartbeat-interval不能小于0")
+	}
+	if sc.SleepTime < 0 {
+		return errors.New("server.sleep-time不能小于0")
+	}
+	if sc.SleepTime == 0 {
+		sc.SleepTime = 5
+	}
+	if sc.ActionTimeout < 0 {
+		return errors.New("server.action-timeout不能小于0")
+	}
+	if sc.ActionTimeout == 0 {
+		sc.ActionTimeout = 30
+	}
+	for i := range sc.Routes {
+		if err := sc.Routes[i].Check(); err != nil {
+			return fmt.Errorf("server.%v", err)
+		}
+	}
+	if err := sc.Arbitration.Check(); err != nil {
+		return fmt.Errorf("server.%v", err)
+	}
+	switch sc.OfflinePolicy {
+	case "":
+		sc.OfflinePolicy = OFFLINE_HOLD
+	case OFFLINE_HOLD, OFFLINE_DISABLE, OFFLINE_DISCONNECT:
+		// ok
+	default:
+		return errors.New("server.offline-policy只能是hold、disable或disconnect")
+	}
+	if sc.ShutdownTimeout < 0 {
+		return errors.New("server.shutdown-timeout不能小于0")
+	}
+	if sc.ShutdownTimeout == 0 {
+		sc.ShutdownTimeout = 10
+	}
+	if err := sc.Keepalive.Check(); err != nil {
+		return fmt.Errorf("server.%v", err)
+	}
+	if err := sc.Compression.Check(); err != nil {
+		return fmt.Errorf("server.%v", err)
+	}
+	sc.allowNets = nil
+	for _, s := range sc.AllowIps {
+		ipNet, err := parseIpNet(s)
+		if err != nil {
+			return fmt.Errorf("server.allow-ips配置错误：%v", err)
+		}
+		sc.allowNets = append(sc.allowNets, ipNet)
+	}
+	switch sc.Mode {
+	case "", MODE_REVERSE:
+		// ok
+	case MODE_FORWARD:
+		if len(sc.Forward) == 0 {
+			return errors.New("server.mode为forward时，server.forward不能为空")
+		}
+		for i := range sc.Forward {
+			if sc.Forward[i].Uri == "" {
+				return fmt.Errorf("server.forward[%d].uri不能为空", i)
+			}
+			if sc.Forward[i].SelfId == "" {
+				sc.Forward[i].SelfId = sc.BotId
+			}
+			if sc.Forward[i].SelfId == "" {
+				return fmt.Errorf("server.forward[%d].self-id和server.bot-id不能都为空", i)
+			}
+			if err := sc.Forward[i].TLS.Check(); err != nil {
+				return fmt.Errorf("server.forward[%d].%v", i, err)
+			}
+		}
+	default:
+		return errors.New("server.mode配置错误，只能是reverse或forward")
+	}
 	switch sc.Default.UserId.Mode {
 	case "", WHITELIST, BLACKLIST:
 		//ok
@@ -125,12 +478,148 @@ func (sc *ServerConfig) Check() error {
 	return nil
 }
 
+// 是否要为账号selfId连接此bot应用
+func (bac *BotAppsConfig) Serves(selfId string) bool {
+	return len(bac.SelfIds) == 0 || slices.Contains(bac.SelfIds, selfId)
+}
+
+func (kc *KeepaliveConfig) Check() error {
+	if kc.PingInterval < 0 || kc.PongTimeout < 0 || kc.ReadTimeout < 0 || kc.WriteTimeout < 0 {
+		return errors.New("keepalive中的时间不能小于0")
+	}
+	if kc.PingInterval > 0 && kc.PongTimeout == 0 {
+		kc.PongTimeout = kc.PingInterval
+	}
+	return nil
+}
+
+func (rc *ReconnectConfig) Check() error {
+	if rc.InitialDelay <= 0 {
+		rc.InitialDelay = float64(CONFIG.Server.SleepTime)
+	}
+	if rc.InitialDelay <= 0 {
+		rc.InitialDelay = 5
+	}
+	if rc.Multiplier == 0 {
+		rc.Multiplier = 2
+	}
+	if rc.Multiplier < 1 {
+		return errors.New("reconnect.multiplier不能小于1")
+	}
+	if rc.MaxDelay <= 0 {
+		rc.MaxDelay = 60
+	}
+	if rc.Jitter < 0 || rc.Jitter > 1 {
+		return errors.New("reconnect.jitter只能在0到1之间")
+	}
+	if rc.MaxAttempts < 0 {
+		return errors.New("reconnect.max-attempts不能小于0")
+	}
+	return nil
+}
+
 func (bac *BotAppsConfig) Check() error {
 	if bac.Name == "" {
 		return errors.New("bot-apps.name不能为空")
 	}
-	if bac.Uri == "" {
-		return fmt.Errorf("%s.uri不能为空", bac.Name)
+	// split-roles时可以只配置event-uri和api-uri
+	splitUris := bac.SplitRoles && bac.EventUri != "" && bac.ApiUri != ""
+	if bac.Uri == "" && !splitUris && bac.ListenPath == "" && bac.HttpApi == "" {
+		return fmt.Errorf("%s.uri、listen-path和http-api不能都为空", bac.Name)
+	}
+	if bac.ListenPath != "" && !strings.HasPrefix(bac.ListenPath, "/") {
+		return fmt.Errorf("%s.listen-path必须以/开头", bac.Name)
+	}
+	switch bac.Type {
+	case "", BOT_APP_TYPE_WS:
+		// ok
+	case BOT_APP_TYPE_HTTP_POST:
+		if bac.Uri == "" || bac.ListenPath != "" {
+			return fmt.Errorf("%s.type为http-post时，uri不能为空，且不能使用listen-path", bac.Name)
+		}
+		if bac.HttpPost.Timeout <= 0 {
+			bac.HttpPost.Timeout = 5
+		}
+		if bac.HttpPost.Retries < 0 {
+			return fmt.Errorf("%s.http-post.retries不能小于0", bac.Name)
+		}
+		if bac.HttpPost.RetryInterval < 0 {
+			return fmt.Errorf("%s.http-post.retry-interval不能小于0", bac.Name)
+		}
+		if bac.HttpPost.RetryInterval == 0 {
+			bac.HttpPost.RetryInterval = 1
+		}
+	default:
+		return fmt.Errorf("%s.type配置错误，只能是ws或http-post", bac.Name)
+	}
+	for _, uri := range []string{bac.Uri, bac.EventUri, bac.ApiUri} {
+		if _, _, err := parseUnixUri(uri, "ws"); err != nil {
+			return fmt.Errorf("%s.%v", bac.Name, err)
+		}
+	}
+	if bac.Proxy != "" {
+		if _, err := parseProxy(bac.Proxy); err != nil {
+			return fmt.Errorf("%s.proxy配置错误：%v", bac.Name, err)
+		}
+	}
+	if bac.SplitRoles {
+		if bac.Type == BOT_APP_TYPE_HTTP_POST || bac.ListenPath != "" {
+			return fmt.Errorf("%s.split-roles只能用于连接反向ws的bot应用", bac.Name)
+		}
+		if bac.EventUri == "" {
+			bac.EventUri = bac.Uri
+		}
+		if bac.ApiUri == "" {
+			bac.ApiUri = bac.Uri
+		}
+		if bac.EventUri == "" || bac.ApiUri == "" {
+			return fmt.Errorf("%s.split-roles时，event-uri和api-uri不能为空", bac.Name)
+		}
+	}
+	if err := bac.TLS.Check(); err != nil {
+		return fmt.Errorf("%s.%v", bac.Name, err)
+	}
+	if err := bac.Reconnect.Check(); err != nil {
+		return fmt.Errorf("%s.%v", bac.Name, err)
+	}
+	if err := bac.Compression.Check(); err != nil {
+		return fmt.Errorf("%s.%v", bac.Name, err)
+	}
+	if bac.DeliveryQueue.Size <= 0 {
+		bac.DeliveryQueue.Size = 1000
+	}
+	switch bac.DeliveryQueue.Overflow {
+	case "":
+		bac.DeliveryQueue.Overflow = OVERFLOW_DROP_OLDEST
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST:
+		// ok
+	case OVERFLOW_DISCONNECT:
+		if bac.Type == BOT_APP_TYPE_HTTP_POST {
+			return fmt.Errorf("%s.delivery-queue.overflow：http-post没有连接可以断开，不能使用disconnect", bac.Name)
+		}
+	default:
+		return fmt.Errorf("%s.delivery-queue.overflow配置错误，只能是block、drop-oldest、drop-newest或disconnect", bac.Name)
+	}
+	if bac.OfflineQueue.MaxSize < 0 || bac.OfflineQueue.Ttl < 0 {
+		return fmt.Errorf("%s.offline-queue.max-size和ttl不能小于0", bac.Name)
+	}
+	if len(bac.OfflineQueue.PostTypes) == 0 {
+		bac.OfflineQueue.PostTypes = []string{"message", "notice", "request"}
+	}
+	if bac.Keepalive.isZero() {
+		bac.Keepalive = CONFIG.Server.Keepalive
+	}
+	if err := bac.Keepalive.Check(); err != nil {
+		return fmt.Errorf("%s.%v", bac.Name, err)
+	}
+	if bac.HttpApi != "" && !strings.HasPrefix(bac.HttpApi, "/") {
+		return fmt.Errorf("%s.http-api必须以/开头", bac.Name)
+	}
+	switch bac.Actions.Mode {
+	case "", ON, WHITELIST, BLACKLIST:
+		// ok
+	default:
+		return fmt.Errorf("%s.actions.mode配置错误，只能是 on、whitelist 或 blacklist", bac.Name)
 	}
 	// 验证账号黑白名单
 	switch bac.UserId.Mode {
@@ -157,6 +646,9 @@ func (bac *BotAppsConfig) Check() error {
 	default:
 		return fmt.Errorf("%s.message.mode配置错误，只能是 on、off、whitelist 或 blacklist", bac.Name)
 	}
+	if err := bac.Message.Segments.Check(); err != nil {
+		return fmt.Errorf("%s.message.%v", bac.Name, err)
+	}
 	// 如果private-message.mode为default，则使用message
 	switch bac.PrivateMessage.Mode {
 	case "", DEFAULT:
@@ -175,5 +667,26 @@ func (bac *BotAppsConfig) Check() error {
 	default:
 		return fmt.Errorf("%s.group-message.mode配置错误，只能是 on、off、whitelist 或 blacklist", bac.Name)
 	}
+	for _, event := range bac.Subscribe {
+		postType, _, _ := strings.Cut(event, ".")
+		switch postType {
+		case POST_TYPE_MESSAGE, POST_TYPE_NOTICE, POST_TYPE_REQUEST, POST_TYPE_META, POST_TYPE_SENT:
+			// ok
+		default:
+			return fmt.Errorf("%s.subscribe配置错误：%s，post_type只能是message、notice、request、meta_event或message_sent", bac.Name, event)
+		}
+	}
+	if err := bac.PrivateMessage.Segments.Check(); err != nil {
+		return fmt.Errorf("%s.private-message.%v", bac.Name, err)
+	}
+	if err := bac.GroupMessage.Segments.Check(); err != nil {
+		return fmt.Errorf("%s.group-message.%v", bac.Name, err)
+	}
+	if err := bac.Notice.Check(); err != nil {
+		return fmt.Errorf("%s.notice.%v", bac.Name, err)
+	}
+	if err := bac.Request.Check(); err != nil {
+		return fmt.Errorf("%s.request.%v", bac.Name, err)
+	}
 	return nil
 }
@@ -0,0 +1,42 @@
+package onebotfilter
+
+import "strings"
+
+// 把字符串格式（CQ码）的消息解析为消息段，CQ码中的参数值都是字符串
+func ParseCQString(s string) []MessageContent {
+	segments := []MessageContent{}
+	appendText := func(text string) {
+		if text != "" {
+			segments = append(segments, MessageContent{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": unescapeCQ(text)}})
+		}
+	}
+	for s != "" {
+		start := strings.Index(s, "[CQ:")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], ']')
+		if end < 0 {
+			break
+		}
+		end += start
+		appendText(s[:start])
+		parts := strings.Split(s[start+len("[CQ:"):end], ",")
+		data := map[string]interface{}{}
+		for _, part := range parts[1:] {
+			key, value, _ := strings.Cut(part, "=")
+			data[key] = unescapeCQ(value)
+		}
+		segments = append(segments, MessageContent{Type: parts[0], Data: data})
+		s = s[end+1:]
+	}
+	appendText(s)
+	return segments
+}
+
+// CQ码的反转义，逗号只在参数值中转义，在文本中不会出现&#44;，可以一起处理
+var cqUnescaper = strings.NewReplacer("&#91;", "[", "&#93;", "]", "&#44;", ",", "&amp;", "&")
+
+func unescapeCQ(s string) string {
+	return cqUnescaper.Replace(s)
+}
@@ -0,0 +1,41 @@
+package onebotfilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCQString(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []MessageContent
+	}{
+		{"纯文本", "你好", []MessageContent{
+			{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": "你好"}},
+		}},
+		{"空消息", "", []MessageContent{}},
+		{"CQ码和文本", "[CQ:at,qq=123] 你好[CQ:face,id=1]", []MessageContent{
+			{Type: "at", Data: map[string]interface{}{"qq": "123"}},
+			{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": " 你好"}},
+			{Type: "face", Data: map[string]interface{}{"id": "1"}},
+		}},
+		{"没有参数", "[CQ:shake]", []MessageContent{
+			{Type: "shake", Data: map[string]interface{}{}},
+		}},
+		{"反转义", "&#91;不是CQ码&#93;[CQ:image,file=a&#44;b.png,url=x?a=1&amp;b=2]", []MessageContent{
+			{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": "[不是CQ码]"}},
+			{Type: "image", Data: map[string]interface{}{"file": "a,b.png", "url": "x?a=1&b=2"}},
+		}},
+		{"没有结束的CQ码", "a[CQ:at,qq=1", []MessageContent{
+			{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": "a[CQ:at,qq=1"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseCQString(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCQString(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
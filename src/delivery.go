@@ -0,0 +1,114 @@
+package onebotfilter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 等待关闭帧放入发送队列的最长时间
+const CLOSE_TIMEOUT = 5 * time.Second
+
+// 发送队列满时的处理方式
+const (
+	OVERFLOW_BLOCK       = "block"       // 等待队列有空位，会阻塞向其他bot应用转发
+	OVERFLOW_DROP_OLDEST = "drop-oldest" // 丢弃队列中最早的消息
+	OVERFLOW_DROP_NEWEST = "drop-newest" // 丢弃新的消息
+	OVERFLOW_DISCONNECT  = "disconnect"  // 断开bot应用的连接，使其重新连接
+)
+
+// 把消息放入发送队列，wait为true时无论配置如何都等待队列有空位，动作响应需要等待
+func (wc *WsClient) push(msg WsMsg, wait bool) error {
+	if wc.ctx.Err() != nil {
+		return errors.New("没有连接到bot应用端")
+	}
+	// 没有订阅的事件不放入队列
+	if wc.filter != nil && !wc.filter.Subscribed(msg) {
+		return nil
+	}
+	overflow := wc.overflow
+	if wait {
+		overflow = OVERFLOW_BLOCK
+	}
+	switch overflow {
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case wc.writeChan <- msg:
+		default:
+			wc.dropped()
+		}
+		return nil
+	case OVERFLOW_DROP_OLDEST:
+		// 动作响应不丢弃，放回队列末尾，队列中都是动作响应时丢弃新的消息
+		for kept := 0; ; {
+			select {
+			case wc.writeChan <- msg:
+				return nil
+			default:
+			}
+			if kept >= cap(wc.writeChan) {
+				wc.dropped()
+				return nil
+			}
+			select {
+			case old := <-wc.writeChan:
+				if !old.Response {
+					wc.dropped()
+					continue
+				}
+				kept++
+				select {
+				case wc.writeChan <- old:
+				case <-wc.ctx.Done():
+					return errors.New("bot应用端连接已断开")
+				}
+			default:
+			}
+		}
+	case OVERFLOW_DISCONNECT:
+		select {
+		case wc.writeChan <- msg:
+			return nil
+		default:
+			wc.dropped()
+			wc.closeConn()
+			return errors.New("发送队列已满，断开连接")
+		}
+	}
+	select {
+	case wc.writeChan <- msg:
+		return nil
+	case <-wc.ctx.Done():
+		return errors.New("bot应用端连接已断开")
+	}
+}
+
+// 把关闭帧放入发送队列，ctx结束时仍然没有空位就直接断开连接
+func (wc *WsClient) pushClose(ctx context.Context, data []byte) {
+	select {
+	case wc.writeChan <- WsMsg{MsgType: websocket.CloseMessage, MsgData: data, Filtered: true}:
+	case <-wc.ctx.Done():
+	case <-ctx.Done():
+		log.Printf("%s的发送队列已满，直接断开连接\n", wc.Name)
+		wc.closeConn()
+	}
+}
+
+// 记录丢弃的消息
+func (wc *WsClient) dropped() {
+	if wc.status == nil {
+		return
+	}
+	dropped := wc.status.addDropped()
+	if dropped%100 == 1 {
+		log.Printf("%s的发送队列已满（%s），已经丢弃了%d条消息\n", wc.Name, wc.overflow, dropped)
+	}
+}
+
+// 发送队列中的消息数量
+func (wc *WsClient) queueDepth() int {
+	return len(wc.writeChan)
+}
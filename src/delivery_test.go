@@ -0,0 +1,85 @@
+package onebotfilter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPushKeepsResponses(t *testing.T) {
+	for _, overflow := range []string{OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST, OVERFLOW_DISCONNECT} {
+		t.Run(overflow, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wc := &WsClient{Name: "bot1", writeChan: make(chan WsMsg, 2), overflow: overflow, ctx: ctx, ctxCancel: cancel}
+			if err := wc.writeResponse([]byte("resp1")); err != nil {
+				t.Fatal(err)
+			}
+			wc.WriteMessage(websocket.TextMessage, []byte("event1"))
+			// 队列已满，新的事件按overflow处理，不能挤掉动作响应
+			wc.WriteMessage(websocket.TextMessage, []byte("event2"))
+			if msg := <-wc.writeChan; string(msg.MsgData) != "resp1" {
+				t.Fatalf("第一条消息 = %s，应该是动作响应", msg.MsgData)
+			}
+			// 队列满时动作响应等待空位，不会被丢弃
+			done := make(chan error, 1)
+			wc.writeChan <- WsMsg{MsgType: websocket.TextMessage, MsgData: []byte("event3")}
+			go func() { done <- wc.writeResponse([]byte("resp2")) }()
+			for string((<-wc.writeChan).MsgData) != "resp2" {
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPushDropOldestAllResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wc := &WsClient{Name: "bot1", writeChan: make(chan WsMsg, 2), overflow: OVERFLOW_DROP_OLDEST, ctx: ctx, ctxCancel: cancel}
+	wc.writeResponse([]byte("resp1"))
+	wc.writeResponse([]byte("resp2"))
+	// 队列中都是动作响应时丢弃新的事件
+	if err := wc.WriteMessage(websocket.TextMessage, []byte("event1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"resp1", "resp2"} {
+		if msg := <-wc.writeChan; string(msg.MsgData) != want {
+			t.Fatalf("消息 = %s，want %s", msg.MsgData, want)
+		}
+	}
+}
+
+func TestPushSkipsUnsubscribed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{Name: "bot1", Subscribe: []string{"message.group"}})
+	wc := &WsClient{Name: "bot1", filter: f, writeChan: make(chan WsMsg, 4), overflow: OVERFLOW_DROP_OLDEST, ctx: ctx, ctxCancel: cancel}
+	wc.WriteMessage(websocket.TextMessage, []byte(`{"post_type":"message","message_type":"private","user_id":1}`))
+	wc.WriteMessage(websocket.TextMessage, []byte(`{"post_type":"notice","notice_type":"group_recall","group_id":5}`))
+	wc.WriteMessage(websocket.TextMessage, []byte(`{"post_type":"message","message_type":"group","group_id":5}`))
+	wc.writeResponse([]byte(`{"status":"ok","retcode":0,"echo":"1"}`))
+	// 没有订阅的事件不放入发送队列，动作响应不受影响
+	if depth := wc.queueDepth(); depth != 2 {
+		t.Fatalf("发送队列中有%d条消息，want 2", depth)
+	}
+}
+
+func TestOfflineQueueSkipsUnsubscribed(t *testing.T) {
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{Name: "bot1", Subscribe: []string{"notice"}})
+	q := &offlineQueue{name: "bot1", cfg: OfflineQueueConfig{MaxSize: 10, PostTypes: []string{POST_TYPE_MESSAGE, POST_TYPE_NOTICE}}, filter: f}
+	tests := []struct {
+		event string
+		want  bool
+	}{
+		{`{"post_type":"notice","notice_type":"group_recall","group_id":5}`, true},
+		{`{"post_type":"message","message_type":"group","group_id":5,"raw_message":"hi","message":"hi"}`, false},
+	}
+	for _, tt := range tests {
+		if got := q.offer(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(tt.event)}); got != tt.want {
+			t.Errorf("offer(%s) = %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package onebotfilter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// 解析代理地址，支持http和socks5
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+		// ok
+	default:
+		return nil, fmt.Errorf("不支持的代理协议：%s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("代理地址缺少主机：%s", s)
+	}
+	return u, nil
+}
+
+// 连接bot应用使用的代理，没有配置proxy时使用环境变量中的代理
+func (bac *BotAppsConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if bac.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	// 已经在Check中检查过
+	u, _ := parseProxy(bac.Proxy)
+	return http.ProxyURL(u)
+}
+
+// 连接bot应用时的请求头
+func (bac *BotAppsConfig) dialHeader(selfId string) http.Header {
+	header := http.Header{}
+	header.Set("x-self-id", selfId)
+	if !bac.TokenInQuery {
+		header.Set("authorization", fmt.Sprintf("Bearer %s", bac.AccessToken))
+	}
+	header.Set("user-agent", CONFIG.Server.UserAgent)
+	header.Set("x-client-role", "Universal")
+	for k, v := range bac.Headers {
+		header.Set(k, v)
+	}
+	return header
+}
+
+// 连接bot应用的地址，token-in-query时添加access_token参数
+func (bac *BotAppsConfig) dialUri(uri string) string {
+	if !bac.TokenInQuery || bac.AccessToken == "" {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		// 由Dial返回错误
+		return uri
+	}
+	query := u.Query()
+	query.Set("access_token", bac.AccessToken)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
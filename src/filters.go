@@ -8,14 +8,20 @@ import (
 	"strings"
 
 	regexp "github.com/dlclark/regexp2"
+	"github.com/gorilla/websocket"
 )
 
 type Filter struct {
 	Name           string
+	SelfId         string // 过滤器所属的OneBot账号
 	UserId         IdFilter
 	GroupId        IdFilter
 	PrivateMessage MessageFilter
 	GroupMessage   MessageFilter
+	Notice         EventFilter
+	Request        EventFilter
+	Subscribe      []string // 订阅的事件，为空时订阅所有事件
+	Actions        ActionFilter
 	// Message MessageFilter 直接使用各自的message配置，在check时已经自动继承
 }
 
@@ -24,6 +30,16 @@ type IdFilter struct {
 	IdConfig
 }
 
+// 动作黑白名单过滤器
+type ActionFilter struct {
+	ActionConfig
+}
+
+// 通知和请求事件过滤器
+type EventFilter struct {
+	EventConfig
+}
+
 // 消息内容过滤器
 type MessageFilter struct {
 	MessageConfig
@@ -66,6 +82,10 @@ func (f *Filter) Filter(onebotMessage *OneBotMessage) bool {
 		return true
 	}
 
+	// 消息段检查
+	if usedFilter != nil && !usedFilter.segmentsPass(f, onebotMessage) {
+		return false
+	}
 	// 若没有指定任何 message 策略或为 ON（表示放行），直接通过
 	if usedFilter == nil || usedFilter.Mode == "" || usedFilter.Mode == ON {
 		if CONFIG.Server.Debug {
@@ -80,6 +100,11 @@ func (f *Filter) Filter(onebotMessage *OneBotMessage) bool {
 		}
 		return false
 	}
+	// 命中路由规则的消息已经按内容选择了这个bot应用，不再检查消息内容的黑白名单，只替换前缀
+	if onebotMessage.Routed {
+		usedFilter.prefixPass(onebotMessage)
+		return true
+	}
 	// 前缀通过检查
 	if usedFilter.prefixPass(onebotMessage) {
 		log.Printf("%s：前缀通过的消息：%s\n", f.Name, onebotMessage.Partial.RawMessage)
@@ -120,6 +145,130 @@ func (f *Filter) Filter(onebotMessage *OneBotMessage) bool {
 	return false
 }
 
+// 使用过滤器处理发送给bot应用端的消息，返回要发送的消息，以及是否通过过滤器
+func (f *Filter) FilterMessage(msg WsMsg) ([]byte, bool) {
+	if msg.MsgType != websocket.TextMessage {
+		return msg.MsgData, true
+	}
+	// 解析onebot的消息
+	onebotMessage := ParseOneBotMessage(msg.MsgData)
+	if onebotMessage == nil {
+		//解析出错的消息也直接放行
+		return msg.MsgData, true
+	}
+	onebotMessage.Routed = msg.Routed
+	// 通知和请求事件
+	switch onebotMessage.Partial.PostType {
+	case POST_TYPE_NOTICE, POST_TYPE_REQUEST:
+		return msg.MsgData, f.FilterEvent(onebotMessage)
+	}
+	// 通常的消息，没有raw_message的消息事件也要过滤
+	if onebotMessage.Partial.RawMessage != "" || onebotMessage.Partial.PostType == POST_TYPE_MESSAGE {
+		if !f.Filter(onebotMessage) {
+			return nil, false
+		}
+		//过滤器通过，发送
+		data, err := json.Marshal(onebotMessage.Intact)
+		if err != nil {
+			log.Printf("打包发送给%s的消息出错：%v\n", f.Name, err)
+			return nil, false
+		}
+		return data, true
+	}
+	//其他消息直接放行
+	return msg.MsgData, true
+}
+
+// 过滤通知和请求事件，没有配置mode时直接放行
+func (f *Filter) FilterEvent(onebotMessage *OneBotMessage) bool {
+	partial := &onebotMessage.Partial
+	var ef *EventFilter
+	var eventType string
+	switch partial.PostType {
+	case POST_TYPE_NOTICE:
+		ef, eventType = &f.Notice, partial.NoticeType
+	case POST_TYPE_REQUEST:
+		ef, eventType = &f.Request, partial.RequestType
+	default:
+		return true
+	}
+	name := partial.PostType + "." + eventType
+	if partial.SubType != "" {
+		name += "." + partial.SubType
+	}
+	switch ef.Mode {
+	case "":
+		return true
+	case OFF:
+		if CONFIG.Server.Debug {
+			log.Printf("%s：被禁止的事件：%s\n", f.Name, name)
+		}
+		return false
+	}
+	// 群和QQ黑白名单检查，没有group_id或user_id的事件不检查
+	if !f.GroupId.Filter(partial.GroupId) || !f.UserId.Filter(partial.UserId) {
+		if CONFIG.Server.Debug {
+			log.Printf("%s：群 %d QQ %d 的事件不通过：%s\n", f.Name, partial.GroupId, partial.UserId, name)
+		}
+		return false
+	}
+	switch ef.Mode {
+	case WHITELIST:
+		if !ef.match(eventType, partial.SubType) {
+			if CONFIG.Server.Debug {
+				log.Printf("%s：不在白名单中的事件：%s\n", f.Name, name)
+			}
+			return false
+		}
+	case BLACKLIST:
+		if ef.match(eventType, partial.SubType) {
+			if CONFIG.Server.Debug {
+				log.Printf("%s：黑名单的事件：%s\n", f.Name, name)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// 事件类型是否在types中，types中的项可以是type或type.sub_type
+func (ef *EventFilter) match(eventType, subType string) bool {
+	for _, t := range ef.Types {
+		if t == eventType || (subType != "" && t == eventType+"."+subType) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否订阅了这个事件，动作响应等不是事件的消息都会通过
+func (f *Filter) Subscribed(msg WsMsg) bool {
+	if len(f.Subscribe) == 0 || msg.MsgType != websocket.TextMessage {
+		return true
+	}
+	var head oneBotFrameHead
+	if err := json.Unmarshal(msg.MsgData, &head); err != nil || head.PostType == "" {
+		return true
+	}
+	var detail string
+	switch head.PostType {
+	case POST_TYPE_MESSAGE, POST_TYPE_SENT:
+		detail = head.MessageType
+	case POST_TYPE_NOTICE:
+		detail = head.NoticeType
+	case POST_TYPE_REQUEST:
+		detail = head.RequestType
+	case POST_TYPE_META:
+		detail = head.MetaEventType
+	}
+	for _, event := range f.Subscribe {
+		if event == head.PostType || (detail != "" && event == head.PostType+"."+detail) {
+			return true
+		}
+	}
+	return false
+}
+
 // Compile 编译过滤器（从配置生成过滤器）
 // 保持函数签名不变，但会把 private/group 的 message 分别设置
 func (f *Filter) Compile(cfg BotAppsConfig) *Filter {
@@ -128,6 +277,10 @@ func (f *Filter) Compile(cfg BotAppsConfig) *Filter {
 	f.GroupId = IdFilter{cfg.GroupId}
 	f.PrivateMessage.Compile(cfg.PrivateMessage)
 	f.GroupMessage.Compile(cfg.GroupMessage)
+	f.Notice = EventFilter{cfg.Notice}
+	f.Request = EventFilter{cfg.Request}
+	f.Subscribe = cfg.Subscribe
+	f.Actions = ActionFilter{cfg.Actions}
 	return f
 }
 
@@ -148,6 +301,7 @@ func (f *MessageFilter) Compile(cfg MessageConfig) *MessageFilter {
 func (f *Filter) String() string {
 	return fmt.Sprintf(`
 name: %s
+self-id: %s
 user-id: %s , ids: %v
 group-id: %s , ids: %v
 private-message: %s
@@ -155,8 +309,13 @@ private-message: %s
 	prefix: [ %s ], replace: %s
 group-message: %s
 	filters: [ %s ]
-	prefix: [ %s ], replace: %s`,
+	prefix: [ %s ], replace: %s
+subscribe: [ %s ]
+notice: %s , types: [ %s ]
+request: %s , types: [ %s ]
+actions: %s , actions: [ %s ]`,
 		f.Name,
+		f.SelfId,
 		f.UserId.Mode, f.UserId.Ids,
 		f.GroupId.Mode, f.GroupId.Ids,
 		f.PrivateMessage.Mode,
@@ -165,6 +324,10 @@ group-message: %s
 		f.GroupMessage.Mode,
 		strings.Join(f.GroupMessage.Filters, ", "),
 		strings.Join(f.GroupMessage.Prefix, ", "), f.GroupMessage.PrefixReplace,
+		strings.Join(f.Subscribe, ", "),
+		f.Notice.Mode, strings.Join(f.Notice.Types, ", "),
+		f.Request.Mode, strings.Join(f.Request.Types, ", "),
+		f.Actions.Mode, strings.Join(f.Actions.Actions, ", "),
 	)
 }
 
@@ -186,6 +349,17 @@ func (idf *IdFilter) Filter(id int64) bool {
 	return true //配置有问题，直接通过吧
 }
 
+// 动作黑白名单过滤
+func (af *ActionFilter) Filter(action string) bool {
+	switch af.Mode {
+	case WHITELIST:
+		return slices.Contains(af.Actions, action)
+	case BLACKLIST:
+		return !slices.Contains(af.Actions, action)
+	}
+	return true
+}
+
 // 前缀通过功能，直接由MessageTypeFilter来处理
 func (mf *MessageFilter) prefixPass(onebotMessage *OneBotMessage) bool {
 	if mf == nil {
@@ -264,6 +438,57 @@ func (mf *MessageFilter) prefixPass(onebotMessage *OneBotMessage) bool {
 	return true
 }
 
+// 消息段过滤，包含block中的消息段，或不包含require中任何一个消息段时不通过
+func (mf *MessageFilter) segmentsPass(f *Filter, onebotMessage *OneBotMessage) bool {
+	if len(mf.Segments.Require) == 0 && len(mf.Segments.Block) == 0 {
+		return true
+	}
+	segments := onebotMessage.Partial.MessageArray
+	if onebotMessage.Partial.MessageFormat == MESSAGE_FORMAT_STRING {
+		segments = ParseCQString(onebotMessage.Partial.MessageString)
+	}
+	for _, rule := range mf.Segments.Block {
+		if rule.matchAny(segments, f.SelfId) {
+			if CONFIG.Server.Debug {
+				log.Printf("%s：包含%s消息段的消息不通过：%s\n", f.Name, rule.Type, onebotMessage.Partial.RawMessage)
+			}
+			return false
+		}
+	}
+	if len(mf.Segments.Require) == 0 {
+		return true
+	}
+	for _, rule := range mf.Segments.Require {
+		if rule.matchAny(segments, f.SelfId) {
+			return true
+		}
+	}
+	if CONFIG.Server.Debug {
+		log.Printf("%s：不包含需要的消息段的消息不通过：%s\n", f.Name, onebotMessage.Partial.RawMessage)
+	}
+	return false
+}
+
+// 是否有消息段与规则匹配
+func (rule *SegmentRule) matchAny(segments []MessageContent, selfId string) bool {
+	return slices.ContainsFunc(segments, func(segment MessageContent) bool {
+		if segment.Type != rule.Type {
+			return false
+		}
+		for key, want := range rule.Data {
+			if want == SEGMENT_SELF {
+				want = selfId
+			}
+			// array格式中的数据可能是数字，统一转为字符串比较
+			value, _ := json.Marshal(segment.Data[key])
+			if jsonId(value) != want {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 // 处理对单个text消息的正则匹配
 func (mf *MessageFilter) processFilter(Name, Text, RawMessage string) *bool {
 	if mf == nil {
@@ -0,0 +1,180 @@
+package onebotfilter
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSegmentRuleMatchAny(t *testing.T) {
+	segments := []MessageContent{
+		{Type: "at", Data: map[string]interface{}{"qq": float64(111)}},
+		{Type: MESSAGE_TYPE_TEXT, Data: map[string]interface{}{"text": "hi"}},
+		{Type: "image", Data: map[string]interface{}{"file": "a.png"}},
+	}
+	tests := []struct {
+		name string
+		rule SegmentRule
+		want bool
+	}{
+		{"类型", SegmentRule{Type: "image"}, true},
+		{"没有这个类型", SegmentRule{Type: "record"}, false},
+		{"at自己", SegmentRule{Type: "at", Data: map[string]string{"qq": SEGMENT_SELF}}, true},
+		{"数字与字符串比较", SegmentRule{Type: "at", Data: map[string]string{"qq": "111"}}, true},
+		{"at其他人", SegmentRule{Type: "at", Data: map[string]string{"qq": "222"}}, false},
+		{"数据不存在", SegmentRule{Type: "image", Data: map[string]string{"url": "x"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matchAny(segments, "111"); got != tt.want {
+				t.Errorf("matchAny() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSegments(t *testing.T) {
+	group := MessageConfig{Mode: ON, Segments: SegmentConfig{
+		Require: []SegmentRule{{Type: "at", Data: map[string]string{"qq": SEGMENT_SELF}}},
+		Block:   []SegmentRule{{Type: "record"}},
+	}}
+	f := (&Filter{Name: "bot1", SelfId: "111"}).Compile(BotAppsConfig{Name: "bot1", GroupMessage: group, PrivateMessage: MessageConfig{Mode: ON}})
+	tests := []struct {
+		name  string
+		event string
+		want  bool
+	}{
+		{"array格式at自己", `{"post_type":"message","message_type":"group","message_format":"array","group_id":5,"user_id":1,"raw_message":"x","message":[{"type":"at","data":{"qq":111}}]}`, true},
+		{"字符串格式at自己", `{"post_type":"message","message_type":"group","message_format":"string","group_id":5,"user_id":1,"raw_message":"x","message":"[CQ:at,qq=111] hi"}`, true},
+		{"没有at自己", `{"post_type":"message","message_type":"group","message_format":"string","group_id":5,"user_id":1,"raw_message":"x","message":"[CQ:at,qq=222] hi"}`, false},
+		{"包含语音", `{"post_type":"message","message_type":"group","message_format":"string","group_id":5,"user_id":1,"raw_message":"x","message":"[CQ:at,qq=111][CQ:record,file=a.amr]"}`, false},
+		{"没有message_format的字符串", `{"post_type":"message","message_type":"group","group_id":5,"user_id":1,"raw_message":"x","message":"[CQ:record,file=a.amr]"}`, false},
+		{"没有message_format的array", `{"post_type":"message","message_type":"group","group_id":5,"user_id":1,"raw_message":"x","message":[{"type":"at","data":{"qq":"111"}}]}`, true},
+		{"没有raw_message", `{"post_type":"message","message_type":"group","group_id":5,"user_id":1,"message":"hi"}`, false},
+		{"私聊不检查", `{"post_type":"message","message_type":"private","user_id":1,"raw_message":"x","message":"[CQ:record,file=a.amr]"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := f.FilterMessage(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(tt.event)}); got != tt.want {
+				t.Errorf("FilterMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterEvent(t *testing.T) {
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{
+		Name:    "bot1",
+		GroupId: IdConfig{Mode: BLACKLIST, Ids: []int64{9}},
+		Notice:  EventConfig{Mode: BLACKLIST, Types: []string{"group_increase", "notify.poke"}},
+		Request: EventConfig{Mode: WHITELIST, Types: []string{"group.invite"}},
+	})
+	tests := []struct {
+		name  string
+		event string
+		want  bool
+	}{
+		{"黑名单中的类型", `{"post_type":"notice","notice_type":"group_increase","group_id":5,"user_id":1}`, false},
+		{"黑名单中的sub_type", `{"post_type":"notice","notice_type":"notify","sub_type":"poke","group_id":5,"user_id":1}`, false},
+		{"其他sub_type", `{"post_type":"notice","notice_type":"notify","sub_type":"honor","group_id":5,"user_id":1}`, true},
+		{"群黑名单", `{"post_type":"notice","notice_type":"group_recall","group_id":9,"user_id":1}`, false},
+		{"白名单中的请求", `{"post_type":"request","request_type":"group","sub_type":"invite","group_id":5,"user_id":1}`, true},
+		{"不在白名单中的请求", `{"post_type":"request","request_type":"friend","user_id":1}`, false},
+		{"元事件不过滤", `{"post_type":"meta_event","meta_event_type":"heartbeat"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := f.FilterMessage(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(tt.event)}); got != tt.want {
+				t.Errorf("FilterMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// 没有配置notice时不过滤，也不使用群黑名单
+	f = (&Filter{Name: "bot2"}).Compile(BotAppsConfig{Name: "bot2", GroupId: IdConfig{Mode: BLACKLIST, Ids: []int64{9}}})
+	if _, ok := f.FilterMessage(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"notice","notice_type":"group_recall","group_id":9}`)}); !ok {
+		t.Error("没有配置notice时通知事件应该通过")
+	}
+}
+
+func TestFilterEventModes(t *testing.T) {
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{
+		Name:    "bot1",
+		UserId:  IdConfig{Mode: WHITELIST, Ids: []int64{1}},
+		Notice:  EventConfig{Mode: ON},
+		Request: EventConfig{Mode: OFF},
+	})
+	tests := []struct {
+		name  string
+		event string
+		want  bool
+	}{
+		{"on时只检查黑白名单", `{"post_type":"notice","notice_type":"group_increase","group_id":5,"user_id":1}`, true},
+		{"不在QQ白名单中", `{"post_type":"notice","notice_type":"group_increase","group_id":5,"user_id":2}`, false},
+		{"没有user_id的事件不检查", `{"post_type":"notice","notice_type":"essence","group_id":5}`, true},
+		{"off时不接收", `{"post_type":"request","request_type":"friend","user_id":1}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := f.FilterMessage(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(tt.event)}); got != tt.want {
+				t.Errorf("FilterMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventConfigCheck(t *testing.T) {
+	for _, mode := range []string{"", ON, OFF, WHITELIST, BLACKLIST} {
+		if err := (&EventConfig{Mode: mode}).Check(); err != nil {
+			t.Errorf("mode %q: %v", mode, err)
+		}
+	}
+	if err := (&EventConfig{Mode: "default"}).Check(); err == nil {
+		t.Error("错误的mode应该返回错误")
+	}
+}
+
+func TestFilterSubscribed(t *testing.T) {
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{Name: "bot1", Subscribe: []string{"message.group", "notice", "meta_event.lifecycle"}})
+	tests := []struct {
+		name string
+		msg  WsMsg
+		want bool
+	}{
+		{"订阅的消息类型", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"message","message_type":"group"}`)}, true},
+		{"没有订阅的消息类型", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"message","message_type":"private"}`)}, false},
+		{"订阅了整个post_type", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"notice","notice_type":"group_recall"}`)}, true},
+		{"没有订阅的post_type", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"request","request_type":"friend"}`)}, false},
+		{"订阅的元事件", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"meta_event","meta_event_type":"lifecycle"}`)}, true},
+		{"没有订阅的元事件", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"meta_event","meta_event_type":"heartbeat"}`)}, false},
+		{"动作响应", WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"status":"ok","retcode":0,"echo":"1"}`)}, true},
+		{"关闭帧", WsMsg{MsgType: websocket.CloseMessage}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Subscribed(tt.msg); got != tt.want {
+				t.Errorf("Subscribed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	f = (&Filter{Name: "bot2"}).Compile(BotAppsConfig{Name: "bot2"})
+	if !f.Subscribed(WsMsg{MsgType: websocket.TextMessage, MsgData: []byte(`{"post_type":"request","request_type":"friend"}`)}) {
+		t.Error("没有配置subscribe时应该订阅所有事件")
+	}
+}
+
+func TestMessageFormatOf(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{`"hi"`, MESSAGE_FORMAT_STRING},
+		{` [{"type":"text","data":{"text":"hi"}}]`, MESSAGE_FORMAT_ARRAY},
+		{`{"type":"text","data":{"text":"hi"}}`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		if got := messageFormatOf([]byte(tt.message)); got != tt.want {
+			t.Errorf("messageFormatOf(%s) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
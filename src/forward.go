@@ -0,0 +1,56 @@
+package onebotfilter
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 正向ws模式，连接到OneBot客户端的ws服务端，断开后重新连接
+func ForwardHandler(cfg ForwardConfig) {
+	header := http.Header{}
+	if cfg.AccessToken != "" {
+		header.Set("authorization", fmt.Sprintf("Bearer %s", cfg.AccessToken))
+	}
+	header.Set("user-agent", CONFIG.Server.UserAgent)
+	tlsConfig, err := cfg.TLS.Build()
+	if err != nil {
+		log.Printf("连接账号%s的OneBot客户端的tls配置有问题：%v\n", cfg.SelfId, err)
+		return
+	}
+	wss := GetWsServer(cfg.SelfId)
+	for !shuttingDown() { //循环重连，退出时不再连接
+		log.Printf("正在连接账号%s的OneBot客户端：%s\n", cfg.SelfId, cfg.Uri)
+		dialer := &websocket.Dialer{
+			Proxy:             http.ProxyFromEnvironment,
+			HandshakeTimeout:  45 * time.Second,
+			ReadBufferSize:    CONFIG.Server.BufferSize,
+			WriteBufferSize:   CONFIG.Server.BufferSize,
+			TLSClientConfig:   tlsConfig,
+			NetDialContext:    (&traffic{}).dialFunc(""),
+			EnableCompression: CONFIG.Server.Compression.Enable,
+		}
+		conn, _, err := dialer.Dial(cfg.Uri, header)
+		if err != nil {
+			log.Printf("连接账号%s的OneBot客户端异常：%v\n", cfg.SelfId, err)
+			sleepUnlessShutdown(seconds(float64(CONFIG.Server.SleepTime)))
+			continue
+		}
+		if err = wss.Attach(conn); err != nil {
+			log.Println(err)
+			conn.Close()
+			sleepUnlessShutdown(seconds(float64(CONFIG.Server.SleepTime)))
+			continue
+		}
+		log.Printf("已连接到账号%s的OneBot客户端\n", cfg.SelfId)
+		err = wss.WsServerHandler()
+		if err != nil {
+			log.Printf("账号%s的OneBot客户端连接异常：%v\n", cfg.SelfId, err)
+		}
+		log.Printf("账号%s的OneBot客户端连接已断开\n", cfg.SelfId)
+		sleepUnlessShutdown(seconds(float64(CONFIG.Server.SleepTime)))
+	}
+}
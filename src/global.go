@@ -2,6 +2,8 @@ package onebotfilter
 
 import (
 	"log"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -15,12 +17,49 @@ const (
 	BLACKLIST = "blacklist"
 )
 
+// 与OneBot客户端的连接方式
+const (
+	MODE_REVERSE = "reverse" // 反向ws，OneBot客户端连接本程序
+	MODE_FORWARD = "forward" // 正向ws，本程序连接OneBot客户端
+)
+
+// OneBot客户端断开时对bot应用的处理方式
+const (
+	OFFLINE_HOLD       = "hold"       // 保持bot应用的连接，等待OneBot客户端重新连接
+	OFFLINE_DISABLE    = "disable"    // 向bot应用发送lifecycle disable事件，重新连接后发送enable
+	OFFLINE_DISCONNECT = "disconnect" // 断开所有bot应用，OneBot客户端重新连接后再连接bot应用
+)
+
+// 仲裁失败的bot应用收到的响应
+const (
+	ARBITRATION_LOSER_OK     = "ok"     // 成功的响应
+	ARBITRATION_LOSER_FAILED = "failed" // 失败的响应，retcode和message可以配置
+)
+
+// bot应用的类型
+const (
+	BOT_APP_TYPE_WS        = "ws"        // 反向ws
+	BOT_APP_TYPE_HTTP_POST = "http-post" // http post上报事件
+)
+
+// 事件类型
+const (
+	POST_TYPE_MESSAGE = "message"
+	POST_TYPE_NOTICE  = "notice"
+	POST_TYPE_REQUEST = "request"
+	POST_TYPE_META    = "meta_event"
+	POST_TYPE_SENT    = "message_sent" // 部分OneBot实现上报的bot自己发送的消息
+)
+
 // 消息类型
 const (
 	PRIVATE = "private"
 	GROUP   = "group"
 )
 
+// 消息段数据中表示bot自己账号的值
+const SEGMENT_SELF = "self"
+
 // 消息格式
 // 消息的内容类型
 const (
@@ -29,6 +68,16 @@ const (
 	MESSAGE_TYPE_TEXT     = "text"
 )
 
+// 本程序自己生成的动作响应使用的retcode，参照OneBot标准中http状态码对应的retcode
+const (
+	RETCODE_BAD_REQUEST = 1400
+	RETCODE_FORBIDDEN   = 1403
+	RETCODE_NOT_FOUND   = 1404
+	RETCODE_CONFLICT    = 1409 // 其他bot应用已经回复了同一条消息
+	RETCODE_OFFLINE     = 1503 // 没有连接到OneBot客户端
+	RETCODE_TIMEOUT     = 1504 // 等待OneBot客户端响应超时
+)
+
 // 布尔值
 var (
 	TRUE  = true
@@ -37,27 +86,94 @@ var (
 
 // 配置文件相关
 var (
-	VP          *viper.Viper
-	CONFIG      Config
-	ALL_FILTERS []*Filter
+	VP           *viper.Viper
+	CONFIG       Config
+	ALL_FILTERS  []*Filter
+	filtersMutex sync.Mutex // 保护ALL_FILTERS，bot应用连接和断开时会在不同的协程中修改
+)
+
+// 已连接过的OneBot账号，key为x-self-id
+var (
+	WS_SERVERS     = map[string]*WsServer{}
+	wsServersMutex sync.Mutex
 )
 
+// 所有账号的WsServer的副本
+func allWsServers() []*WsServer {
+	wsServersMutex.Lock()
+	defer wsServersMutex.Unlock()
+	servers := make([]*WsServer, 0, len(WS_SERVERS))
+	for _, wss := range WS_SERVERS {
+		servers = append(servers, wss)
+	}
+	return servers
+}
+
 type WsMsg struct {
-	MsgType int
-	MsgData []byte
+	MsgType  int
+	MsgData  []byte
+	Filtered bool // 已经使用过滤器处理过，发送时不再过滤
+	Response bool // 动作响应，发送队列满时也不会丢弃
+	Routed   bool // 命中了独占路由规则，过滤时不再检查消息内容
+}
+
+// 获取已经创建的账号对应的WsServer，没有时返回nil
+func LookupWsServer(selfId string) *WsServer {
+	wsServersMutex.Lock()
+	defer wsServersMutex.Unlock()
+	return WS_SERVERS[selfId]
+}
+
+// 获取账号对应的WsServer，第一次获取时会创建，并为它连接所有bot应用
+func GetWsServer(selfId string) *WsServer {
+	wsServersMutex.Lock()
+	defer wsServersMutex.Unlock()
+	if wss, ok := WS_SERVERS[selfId]; ok {
+		return wss
+	}
+	wss := &WsServer{SelfId: selfId}
+	WS_SERVERS[selfId] = wss
+	for _, bacfg := range CONFIG.BotApps {
+		if !bacfg.Serves(selfId) {
+			continue
+		}
+		// 由bot应用主动连接的，或者只使用http api的，不需要去连接它
+		if bacfg.ListenPath != "" {
+			wss.botAppStatus(bacfg.Name).set(STATE_DISCONNECTED, 0, nil, time.Time{})
+			prepareListenQueue(wss, bacfg)
+			continue
+		}
+		if bacfg.Uri == "" && !bacfg.SplitRoles {
+			continue
+		}
+		if bacfg.Type == BOT_APP_TYPE_HTTP_POST {
+			go HttpPostHandler(wss, bacfg)
+			continue
+		}
+		go WsClientHandler(wss, bacfg)
+	}
+	if CONFIG.Server.MetaEvent.HeartbeatInterval > 0 {
+		go wss.heartbeatLoop()
+	}
+	log.Printf("已为账号%s加载bot应用\n", selfId)
+	return wss
 }
 
 func AddFilter(filter *Filter) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
 	for _, f := range ALL_FILTERS {
-		if f.Name == filter.Name {
+		if f.Name == filter.Name && f.SelfId == filter.SelfId {
 			return
 		}
 	}
 	ALL_FILTERS = append(ALL_FILTERS, filter)
 }
-func RemoveFilter(name string) {
+func RemoveFilter(name, selfId string) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
 	for i, f := range ALL_FILTERS {
-		if f.Name == name {
+		if f.Name == name && f.SelfId == selfId {
 			ALL_FILTERS = append(ALL_FILTERS[:i], ALL_FILTERS[i+1:]...)
 			return
 		}
@@ -66,6 +182,8 @@ func RemoveFilter(name string) {
 
 // 重新加载所有过滤器
 func ReLoadFilters() error {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
 	for _, botApp := range CONFIG.BotApps {
 		//检查配置
 		err := botApp.Check()
@@ -73,11 +191,11 @@ func ReLoadFilters() error {
 			log.Printf("bot %s 的配置文件校验失败：%v\n", botApp.Name, err)
 			continue
 		}
+		// 每个账号都有各自的过滤器
 		for _, filter := range ALL_FILTERS {
 			if filter.Name == botApp.Name {
 				filter.Compile(botApp)
 				log.Printf("已重新加载过滤器：%s\n", filter.String())
-				break
 			}
 		}
 	}
@@ -0,0 +1,128 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 为bot应用提供OneBot v11的http api，把请求转为ws的动作请求发给OneBot客户端
+func BotAppHttpHandler(cfg BotAppsConfig) http.HandlerFunc {
+	if err := cfg.Check(); err != nil {
+		log.Printf("%s的配置有问题: %v\n", cfg.Name, err)
+	}
+	// 动作黑白名单需要随配置文件重新加载
+	filter := (&Filter{Name: cfg.Name}).Compile(cfg)
+	AddFilter(filter)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status := CheckAccessToken(r, cfg.AccessToken); status != 0 {
+			log.Printf("%s的http api请求未通过access token验证，来自：%s\n", cfg.Name, r.RemoteAddr)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		actionName := strings.Trim(strings.TrimPrefix(r.URL.Path, cfg.HttpApi), "/")
+		if actionName == "" {
+			http.NotFound(w, r)
+			return
+		}
+		params, status := parseHttpParams(r)
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if !filter.Actions.Filter(actionName) {
+			log.Printf("%s：不允许的动作：%s\n", cfg.Name, actionName)
+			writeHttpResponse(w, NewFailedResponse(RETCODE_FORBIDDEN, "不允许的动作："+actionName, nil))
+			return
+		}
+		wss := findWsServer(r)
+		if wss == nil || !cfg.Serves(wss.SelfId) {
+			writeHttpResponse(w, NewFailedResponse(RETCODE_OFFLINE, "没有连接到OneBot客户端", nil))
+			return
+		}
+		action := OneBotAction{Action: actionName, Params: params}
+		msg, err := json.Marshal(action)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !wss.waitArbitration(cfg.Name, cfg.Priority, &action) {
+			writeHttpResponse(w, arbitrationLoserResponse(nil))
+			return
+		}
+		resp, err := wss.CallAction(cfg.Name, msg, seconds(CONFIG.Server.ActionTimeout))
+		if err != nil {
+			log.Printf("%s的http api请求%s出错：%v\n", cfg.Name, actionName, err)
+			retcode := RETCODE_OFFLINE
+			if wss.Connected() {
+				retcode = RETCODE_TIMEOUT
+			}
+			writeHttpResponse(w, NewFailedResponse(retcode, err.Error(), nil))
+			return
+		}
+		writeHttpResponse(w, resp)
+	}
+}
+
+// 按照OneBot v11的http api标准解析参数，query参数和请求体中的参数会合并
+// 出错时返回应当响应的http状态码
+func parseHttpParams(r *http.Request) (json.RawMessage, int) {
+	params := map[string]any{}
+	for k, v := range r.URL.Query() {
+		if k == "access_token" || len(v) == 0 {
+			continue
+		}
+		params[k] = v[0]
+	}
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest
+		}
+		if len(body) > 0 {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			switch mediaType {
+			case "application/json":
+				if err = json.Unmarshal(body, &params); err != nil {
+					return nil, http.StatusBadRequest
+				}
+			case "application/x-www-form-urlencoded":
+				form, err := url.ParseQuery(string(body))
+				if err != nil {
+					return nil, http.StatusBadRequest
+				}
+				for k, v := range form {
+					if len(v) > 0 {
+						params[k] = v[0]
+					}
+				}
+			default:
+				return nil, http.StatusNotAcceptable
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		return nil, http.StatusMethodNotAllowed
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	return data, 0
+}
+
+// 把动作响应写回http，去掉echo
+func writeHttpResponse(w http.ResponseWriter, resp []byte) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp, &data); err == nil {
+		delete(data, "echo")
+		if newResp, err := json.Marshal(data); err == nil {
+			resp = newResp
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
@@ -0,0 +1,260 @@
+package onebotfilter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 使用http post向bot应用上报事件
+type httpPoster struct {
+	name     string
+	uri      string
+	cfg      HttpPostConfig
+	wss      *WsServer
+	filter   *Filter // 快速操作也要经过动作黑白名单
+	client   *http.Client
+	headers  map[string]string // 额外添加的请求头
+	priority int               // 回复仲裁时的优先级
+}
+
+// 快速操作中需要的事件字段
+type quickOperationContext struct {
+	PostType    string `json:"post_type"`
+	MessageType string `json:"message_type"`
+	UserId      int64  `json:"user_id"`
+	GroupId     int64  `json:"group_id"`
+}
+
+// 以http post方式向bot应用上报过滤后的事件，并处理快速操作
+func HttpPostHandler(wss *WsServer, cfg BotAppsConfig) {
+	//检查配置
+	err := cfg.Check()
+	if err != nil {
+		log.Printf("%s的配置有问题: %v\n", cfg.Name, err)
+		return
+	}
+	tlsConfig, err := cfg.TLS.Build()
+	if err != nil {
+		log.Printf("%s的tls配置有问题: %v\n", cfg.Name, err)
+		return
+	}
+	//filter
+	filter := (&Filter{Name: cfg.Name, SelfId: wss.SelfId}).Compile(cfg)
+	AddFilter(filter)
+	defer RemoveFilter(filter.Name, filter.SelfId)
+	//client
+	sock, uri, err := parseUnixUri(cfg.Uri, "http")
+	if err != nil {
+		log.Printf("%s的uri有问题: %v\n", cfg.Name, err)
+		return
+	}
+	proxy := cfg.proxyFunc()
+	if sock != "" {
+		proxy = nil
+	}
+	client := newWsClient(cfg, nil, filter)
+	client.poster = &httpPoster{
+		name:     cfg.Name,
+		uri:      uri,
+		headers:  cfg.Headers,
+		priority: cfg.Priority,
+		cfg:      cfg.HttpPost,
+		wss:      wss,
+		filter:   filter,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.HttpPost.Timeout * float32(time.Second)),
+			Transport: &http.Transport{
+				Proxy:           proxy,
+				TLSClientConfig: tlsConfig,
+				DialContext:     client.traffic.dialFunc(sock),
+			},
+		},
+	}
+	if err = wss.AddWsClient(client); err != nil {
+		log.Printf("连接%s异常: %v\n", cfg.Name, err)
+		return
+	}
+	defer wss.RemoveWsClient(client.Name)
+	wss.botAppStatus(cfg.Name).set(STATE_CONNECTED, 0, nil, time.Time{})
+	log.Printf("账号%s将以http post向%s上报事件，加载的过滤器：%s\n", wss.SelfId, cfg.Name, filter.String())
+	client.writeLoop(client.ctx)
+}
+
+// 上报事件，失败时按配置重试，重试的间隔每次翻倍，正在退出时不再重试
+func (hp *httpPoster) post(data []byte) error {
+	var err error
+	retry := &backoff{cfg: ReconnectConfig{InitialDelay: hp.cfg.RetryInterval, Multiplier: 2}}
+	for i := 0; i <= hp.cfg.Retries; i++ {
+		if i > 0 {
+			log.Printf("向%s上报事件失败，第%d次重试：%v\n", hp.name, i, err)
+			delay, _ := retry.next()
+			if !sleepUnlessShutdown(delay) {
+				break
+			}
+		}
+		var body []byte
+		var retry bool
+		body, retry, err = hp.do(data)
+		if err == nil {
+			if len(bytes.TrimSpace(body)) > 0 {
+				go hp.quickOperation(data, body)
+			}
+			return nil
+		}
+		if !retry {
+			break
+		}
+	}
+	return err
+}
+
+// 发送一次http post请求，返回响应体，以及出错时是否可以重试
+func (hp *httpPoster) do(data []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hp.uri, bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Self-ID", hp.wss.SelfId)
+	req.Header.Set("User-Agent", CONFIG.Server.UserAgent)
+	for k, v := range hp.headers {
+		req.Header.Set(k, v)
+	}
+	if hp.cfg.Secret != "" {
+		// OneBot v11标准的签名：HMAC-SHA1(secret, body)
+		mac := hmac.New(sha1.New, []byte(hp.cfg.Secret))
+		mac.Write(data)
+		req.Header.Set("X-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("http状态码：%d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return nil, false, fmt.Errorf("http状态码：%d", resp.StatusCode)
+	case resp.StatusCode == http.StatusNoContent:
+		return nil, false, nil
+	}
+	return body, false, nil
+}
+
+// 处理http post响应中的快速操作
+// reply会转为send_msg动作，其他操作交给OneBot客户端的.handle_quick_operation处理
+func (hp *httpPoster) quickOperation(event, body []byte) {
+	var operation map[string]json.RawMessage
+	if err := json.Unmarshal(body, &operation); err != nil {
+		log.Printf("%s返回的快速操作无法解析：%s\n", hp.name, body)
+		return
+	}
+	var ctx quickOperationContext
+	if err := json.Unmarshal(event, &ctx); err != nil {
+		return
+	}
+	if reply, ok := operation["reply"]; ok && ctx.PostType == "message" {
+		hp.reply(ctx, reply, operation["auto_escape"], operation["at_sender"])
+	}
+	delete(operation, "reply")
+	delete(operation, "auto_escape")
+	delete(operation, "at_sender")
+	if len(operation) == 0 {
+		return
+	}
+	msg, err := json.Marshal(map[string]any{
+		"action": ".handle_quick_operation",
+		"params": map[string]any{
+			"context":   json.RawMessage(event),
+			"operation": operation,
+		},
+	})
+	if err != nil {
+		return
+	}
+	hp.callAction(msg)
+}
+
+// 快速回复，转为send_msg动作
+func (hp *httpPoster) reply(ctx quickOperationContext, reply, autoEscape, atSender json.RawMessage) {
+	var escape bool
+	json.Unmarshal(autoEscape, &escape)
+	at := ctx.MessageType == GROUP // 群聊中at_sender默认为true
+	if len(atSender) > 0 {
+		json.Unmarshal(atSender, &at)
+	}
+	message := any(reply)
+	if at {
+		atSegment := MessageContent{Type: "at", Data: map[string]any{"qq": fmt.Sprint(ctx.UserId)}}
+		var text string
+		var segments []json.RawMessage
+		if err := json.Unmarshal(reply, &text); err == nil {
+			if escape {
+				message = []any{atSegment, MessageContent{Type: MESSAGE_TYPE_TEXT, Data: map[string]any{"text": " " + text}}}
+			} else {
+				message = fmt.Sprintf("[CQ:at,qq=%d] %s", ctx.UserId, text)
+			}
+		} else if err := json.Unmarshal(reply, &segments); err == nil {
+			message = append([]any{atSegment}, toAny(segments)...)
+		} else {
+			message = []any{atSegment, reply}
+		}
+	}
+	params := map[string]any{
+		"message_type": ctx.MessageType,
+		"user_id":      ctx.UserId,
+		"message":      message,
+		"auto_escape":  escape,
+	}
+	if ctx.MessageType == GROUP {
+		params["group_id"] = ctx.GroupId
+	}
+	msg, err := json.Marshal(map[string]any{"action": "send_msg", "params": params})
+	if err != nil {
+		return
+	}
+	hp.callAction(msg)
+}
+
+func (hp *httpPoster) callAction(msg []byte) {
+	action := ParseOneBotAction(msg)
+	if action != nil && !hp.filter.Actions.Filter(action.Action) {
+		log.Printf("%s：不允许的快速操作：%s\n", hp.name, action.Action)
+		return
+	}
+	if action != nil && !hp.wss.waitArbitration(hp.name, hp.priority, action) {
+		if CONFIG.Server.Debug {
+			log.Printf("%s的快速操作没有在回复仲裁中胜出：%s\n", hp.name, msg)
+		}
+		return
+	}
+	resp, err := hp.wss.CallAction(hp.name, msg, seconds(CONFIG.Server.ActionTimeout))
+	if err != nil {
+		log.Printf("%s的快速操作出错：%v\n", hp.name, err)
+		return
+	}
+	if CONFIG.Server.Debug {
+		log.Printf("%s的快速操作的响应：%s\n", hp.name, resp)
+	}
+}
+
+func toAny(segments []json.RawMessage) []any {
+	result := make([]any, len(segments))
+	for i, s := range segments {
+		result[i] = s
+	}
+	return result
+}
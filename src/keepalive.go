@@ -0,0 +1,94 @@
+package onebotfilter
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 读取超时时间，为0时不限制
+// 没有配置read-timeout时，如果发送ping，则为ping-interval+pong-timeout
+func (kc *KeepaliveConfig) readTimeout() time.Duration {
+	if kc.ReadTimeout > 0 {
+		return seconds(kc.ReadTimeout)
+	}
+	if kc.PingInterval > 0 {
+		return seconds(kc.PingInterval + kc.PongTimeout)
+	}
+	return 0
+}
+
+// 写入超时时间，为0时不限制
+func (kc *KeepaliveConfig) writeTimeout() time.Duration {
+	return seconds(kc.WriteTimeout)
+}
+
+// 是否没有任何配置
+func (kc *KeepaliveConfig) isZero() bool {
+	return kc.PingInterval == 0 && kc.PongTimeout == 0 && kc.ReadTimeout == 0 && kc.WriteTimeout == 0
+}
+
+// 设置读取超时，并定时发送ping，对方停止响应时关闭连接，使读取循环结束
+// 每次读取到消息后需要调用extendReadDeadline
+func startKeepalive(ctx context.Context, conn *websocket.Conn, kc KeepaliveConfig) {
+	if timeout := kc.readTimeout(); timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(timeout))
+		})
+		conn.SetPingHandler(func(data string) error {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(controlTimeout(kc)))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			return err
+		})
+	}
+	if kc.PingInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(seconds(kc.PingInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(controlTimeout(kc))); err != nil {
+					conn.Close()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// 读取到消息后延长读取超时
+func extendReadDeadline(conn *websocket.Conn, kc KeepaliveConfig) {
+	if timeout := kc.readTimeout(); timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// 写入消息，设置写入超时
+func writeWithDeadline(conn *websocket.Conn, kc KeepaliveConfig, mt int, data []byte) error {
+	if timeout := kc.writeTimeout(); timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return conn.WriteMessage(mt, data)
+}
+
+// 发送ping和pong的超时时间
+func controlTimeout(kc KeepaliveConfig) time.Duration {
+	if timeout := kc.writeTimeout(); timeout > 0 {
+		return timeout
+	}
+	return 10 * time.Second
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
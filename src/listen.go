@@ -0,0 +1,117 @@
+package onebotfilter
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// bot应用端作为正向ws客户端连接本程序时的处理方法
+func BotAppHandler(cfg BotAppsConfig) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    CONFIG.Server.BufferSize,
+		WriteBufferSize:   CONFIG.Server.BufferSize,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: cfg.Compression.Enable,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status := CheckAccessToken(r, cfg.AccessToken); status != 0 {
+			log.Printf("%s的连接请求未通过access token验证，来自：%s\n", cfg.Name, r.RemoteAddr)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		wss := findWsServer(r)
+		if wss == nil {
+			http.Error(w, "找不到要连接的账号", http.StatusNotFound)
+			return
+		}
+		if !cfg.Serves(wss.SelfId) {
+			http.Error(w, "此bot应用没有为该账号开放", http.StatusForbidden)
+			return
+		}
+		if wss.holdBotApps() {
+			http.Error(w, "OneBot客户端没有连接", http.StatusServiceUnavailable)
+			return
+		}
+		if wss.getWsClient(cfg.Name) != nil {
+			http.Error(w, "已经连接过"+cfg.Name, http.StatusConflict)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("%s连接异常：%v\n", cfg.Name, err)
+			return
+		}
+		// 使用启动时的配置补全默认值并编译过滤器，过滤器之后随配置文件的修改重新加载
+		cfg := cfg
+		if err = cfg.Check(); err != nil {
+			log.Printf("%s的配置有问题: %v\n", cfg.Name, err)
+			conn.Close()
+			return
+		}
+		// 启用了离线队列时，过滤器随离线队列一直保留
+		queue := wss.getOfflineQueue(cfg.Name)
+		var filter *Filter
+		if queue != nil {
+			filter = queue.filter
+		} else {
+			filter = (&Filter{Name: cfg.Name, SelfId: wss.SelfId}).Compile(cfg)
+		}
+		client := newWsClient(cfg, conn, filter)
+		client.queue = queue
+		if err = wss.AddWsClient(client); err != nil {
+			log.Printf("%s连接异常：%v\n", cfg.Name, err)
+			conn.Close()
+			return
+		}
+		if queue == nil {
+			AddFilter(filter)
+			defer RemoveFilter(filter.Name, filter.SelfId)
+		}
+		status := wss.botAppStatus(cfg.Name)
+		status.set(STATE_CONNECTED, 0, nil, time.Time{})
+		log.Printf("%s已连接到账号%s，加载的过滤器：%s\n", cfg.Name, wss.SelfId, filter.String())
+		err = client.serve(wss)
+		status.set(STATE_DISCONNECTED, 0, err, time.Time{})
+		log.Printf("%s的连接已断开：%v\n", cfg.Name, err)
+	}
+}
+
+// 找到bot应用要连接的账号
+// 依次使用X-Self-ID请求头、self_id参数、server.bot-id，都没有时如果只有一个账号就使用它
+func findWsServer(r *http.Request) *WsServer {
+	selfId := r.Header.Get("X-Self-ID")
+	if selfId == "" {
+		selfId = r.URL.Query().Get("self_id")
+	}
+	if selfId == "" {
+		selfId = CONFIG.Server.BotId
+	}
+	wsServersMutex.Lock()
+	defer wsServersMutex.Unlock()
+	if selfId != "" {
+		return WS_SERVERS[selfId]
+	}
+	if len(WS_SERVERS) == 1 {
+		for _, wss := range WS_SERVERS {
+			return wss
+		}
+	}
+	return nil
+}
+
+// 账号加载时，为启用了离线队列的bot应用创建离线队列，使它在第一次连接之前也能保存事件
+func prepareListenQueue(wss *WsServer, cfg BotAppsConfig) {
+	if err := cfg.Check(); err != nil {
+		log.Printf("%s的配置有问题: %v\n", cfg.Name, err)
+		return
+	}
+	if cfg.OfflineQueue.MaxSize <= 0 {
+		return
+	}
+	filter := (&Filter{Name: cfg.Name, SelfId: wss.SelfId}).Compile(cfg)
+	AddFilter(filter)
+	wss.addOfflineQueue(cfg, filter)
+}
@@ -0,0 +1,124 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 生命周期事件的sub_type
+const (
+	LIFECYCLE_CONNECT = "connect"
+	LIFECYCLE_ENABLE  = "enable"
+	LIFECYCLE_DISABLE = "disable"
+)
+
+// 本程序生成的元事件
+type metaEvent struct {
+	Time          int64            `json:"time"`
+	SelfId        int64            `json:"self_id"`
+	PostType      string           `json:"post_type"`
+	MetaEventType string           `json:"meta_event_type"`
+	SubType       string           `json:"sub_type,omitempty"`
+	Status        *heartbeatStatus `json:"status,omitempty"`
+	Interval      int64            `json:"interval,omitempty"`
+}
+
+type heartbeatStatus struct {
+	Online bool `json:"online"`
+	Good   bool `json:"good"`
+}
+
+func (wss *WsServer) newMetaEvent(metaEventType string) metaEvent {
+	selfId, _ := strconv.ParseInt(wss.SelfId, 10, 64)
+	return metaEvent{
+		Time:          time.Now().Unix(),
+		SelfId:        selfId,
+		PostType:      "meta_event",
+		MetaEventType: metaEventType,
+	}
+}
+
+// 生成生命周期事件
+func (wss *WsServer) newLifecycleEvent(subType string) []byte {
+	event := wss.newMetaEvent("lifecycle")
+	event.SubType = subType
+	data, _ := json.Marshal(event)
+	return data
+}
+
+// 生成心跳事件，状态来自与OneBot客户端的连接
+func (wss *WsServer) newHeartbeatEvent() []byte {
+	event := wss.newMetaEvent("heartbeat")
+	online := wss.Connected()
+	event.Status = &heartbeatStatus{Online: online, Good: online}
+	event.Interval = seconds(CONFIG.Server.MetaEvent.HeartbeatInterval).Milliseconds()
+	data, _ := json.Marshal(event)
+	return data
+}
+
+// 向所有bot应用发送本程序生成的元事件
+func (wss *WsServer) broadcastMetaEvent(data []byte) {
+	for _, wsClient := range wss.clients() {
+		if err := wsClient.writeFiltered(websocket.TextMessage, data); err != nil {
+			log.Printf("向 %s 发送元事件出错：%v\n", wsClient.Name, err)
+		}
+	}
+}
+
+// OneBot客户端连接或断开时，通知所有bot应用
+// offline-policy为disable时，即使没有启用meta-event.lifecycle也会通知
+func (wss *WsServer) notifyLifecycle(subType string) {
+	if !CONFIG.Server.MetaEvent.Lifecycle && CONFIG.Server.OfflinePolicy != OFFLINE_DISABLE {
+		return
+	}
+	wss.broadcastMetaEvent(wss.newLifecycleEvent(subType))
+}
+
+// bot应用连接后，先发送lifecycle connect，OneBot客户端不在线时接着发送disable
+func (wss *WsServer) greetClient(wc *WsClient) {
+	var subTypes []string
+	if CONFIG.Server.MetaEvent.Lifecycle {
+		subTypes = append(subTypes, LIFECYCLE_CONNECT)
+	}
+	if (CONFIG.Server.MetaEvent.Lifecycle || CONFIG.Server.OfflinePolicy == OFFLINE_DISABLE) && !wss.Connected() {
+		subTypes = append(subTypes, LIFECYCLE_DISABLE)
+	}
+	for _, subType := range subTypes {
+		if err := wc.writeFiltered(websocket.TextMessage, wss.newLifecycleEvent(subType)); err != nil {
+			log.Printf("向%s发送元事件出错：%v\n", wc.Name, err)
+			return
+		}
+	}
+}
+
+// 定时向所有bot应用发送心跳事件
+func (wss *WsServer) heartbeatLoop() {
+	ticker := time.NewTicker(seconds(CONFIG.Server.MetaEvent.HeartbeatInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wss.broadcastMetaEvent(wss.newHeartbeatEvent())
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+// 是否是需要由本程序生成的元事件，OneBot客户端发来的这类事件不再转发
+func isReplacedMetaEvent(head oneBotFrameHead) bool {
+	if head.PostType != "meta_event" {
+		return false
+	}
+	switch head.MetaEventType {
+	case "lifecycle":
+		return CONFIG.Server.MetaEvent.Lifecycle
+	case "heartbeat":
+		return CONFIG.Server.MetaEvent.HeartbeatInterval > 0
+	}
+	return false
+}
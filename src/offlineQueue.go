@@ -0,0 +1,187 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// bot应用断开期间保存事件的队列，重新连接后按顺序补发
+type offlineQueue struct {
+	name   string
+	cfg    OfflineQueueConfig
+	filter *Filter
+	mutex  sync.Mutex
+	online bool          // bot应用已连接，并且已经补发完队列中的事件
+	items  []queuedEvent // 保存的事件，已经使用过滤器处理过
+}
+
+type queuedEvent struct {
+	data []byte
+	time time.Time
+}
+
+// 为bot应用创建离线队列，已经存在时直接返回，没有启用时返回nil
+func (wss *WsServer) addOfflineQueue(cfg BotAppsConfig, filter *Filter) *offlineQueue {
+	if cfg.OfflineQueue.MaxSize <= 0 {
+		return nil
+	}
+	wss.statusMutex.Lock()
+	defer wss.statusMutex.Unlock()
+	if wss.offlineQueues == nil {
+		wss.offlineQueues = map[string]*offlineQueue{}
+	}
+	if q, ok := wss.offlineQueues[cfg.Name]; ok {
+		return q
+	}
+	q := &offlineQueue{name: cfg.Name, cfg: cfg.OfflineQueue, filter: filter}
+	wss.offlineQueues[cfg.Name] = q
+	return q
+}
+
+// 获取bot应用的离线队列，没有时返回nil
+func (wss *WsServer) getOfflineQueue(name string) *offlineQueue {
+	wss.statusMutex.Lock()
+	defer wss.statusMutex.Unlock()
+	return wss.offlineQueues[name]
+}
+
+// 把事件交给所有离线的bot应用的队列，返回保存了事件的bot应用的名字，这些bot应用不需要再直接发送
+// 队列不保存的事件（元事件、不在post-types中的事件）仍然直接发送，正在补发的bot应用也能收到
+func (wss *WsServer) offerOfflineQueues(msg WsMsg) []string {
+	wss.statusMutex.Lock()
+	queues := make([]*offlineQueue, 0, len(wss.offlineQueues))
+	for _, q := range wss.offlineQueues {
+		queues = append(queues, q)
+	}
+	wss.statusMutex.Unlock()
+	var stored []string
+	for _, q := range queues {
+		if q.offer(msg) {
+			stored = append(stored, q.name)
+		}
+	}
+	return stored
+}
+
+// bot应用离线或正在补发时保存事件，返回是否保存，bot应用在线或者队列不保存这个事件时返回false
+func (q *offlineQueue) offer(msg WsMsg) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.online {
+		return false
+	}
+	return q.store(msg)
+}
+
+// 过滤后保存事件，返回是否保存，需要持有锁
+func (q *offlineQueue) store(msg WsMsg) bool {
+	if msg.MsgType != websocket.TextMessage {
+		return false
+	}
+	var head oneBotFrameHead
+	if err := json.Unmarshal(msg.MsgData, &head); err != nil || !slices.Contains(q.cfg.PostTypes, head.PostType) {
+		return false
+	}
+	if !q.filter.Subscribed(msg) {
+		return false
+	}
+	data := msg.MsgData
+	if !msg.Filtered {
+		var ok bool
+		if data, ok = q.filter.FilterMessage(msg); !ok {
+			return false
+		}
+	}
+	q.dropExpired()
+	if len(q.items) >= q.cfg.MaxSize {
+		// 队列满了，丢弃最早的事件
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, queuedEvent{data: data, time: time.Now()})
+	return true
+}
+
+// 丢弃超过ttl的事件，需要持有锁
+func (q *offlineQueue) dropExpired() {
+	if q.cfg.Ttl <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-seconds(q.cfg.Ttl))
+	i := 0
+	for i < len(q.items) && q.items[i].time.Before(deadline) {
+		i++
+	}
+	q.items = q.items[i:]
+}
+
+// bot应用连接后，按顺序补发队列中的事件，之后的事件直接发送
+// 补发时不持有锁，期间收到的事件继续放入队列，在下一轮补发
+func (q *offlineQueue) goOnline(wc *WsClient) {
+	for {
+		q.mutex.Lock()
+		q.dropExpired()
+		items := q.items
+		q.items = nil
+		if len(items) == 0 {
+			q.online = true
+			q.mutex.Unlock()
+			return
+		}
+		q.mutex.Unlock()
+		log.Printf("向%s补发离线期间的%d条事件\n", q.name, len(items))
+		for i, item := range items {
+			// 补发时不丢弃，等待发送队列有空位
+			if err := wc.push(WsMsg{MsgType: websocket.TextMessage, MsgData: item.data, Filtered: true}, true); err != nil {
+				log.Printf("向%s补发事件出错：%v\n", q.name, err)
+				// 没有补发的事件放回队列前面，下次连接时再补发
+				q.mutex.Lock()
+				q.items = q.trim(slices.Concat(items[i:], q.items))
+				q.mutex.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// 超过max-size时丢弃最早的事件
+func (q *offlineQueue) trim(items []queuedEvent) []queuedEvent {
+	if len(items) > q.cfg.MaxSize {
+		return items[len(items)-q.cfg.MaxSize:]
+	}
+	return items
+}
+
+// bot应用断开后，开始保存事件，发送队列中还没有发送的事件放在最前面
+func (q *offlineQueue) goOffline(wc *WsClient) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.online = false
+	// 停止writeLoop后再取出发送队列中的事件
+	wc.ctxCancel()
+	queued := q.items
+	q.items = nil
+	for drained := false; !drained; {
+		select {
+		case msg := <-wc.writeChan:
+			q.store(msg)
+		default:
+			drained = true
+		}
+	}
+	if len(q.items) > 0 {
+		log.Printf("%s断开时发送队列中还有%d条事件，已放入离线队列\n", q.name, len(q.items))
+	}
+	q.items = q.trim(append(q.items, queued...))
+}
+
+// 队列中的事件数量
+func (q *offlineQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
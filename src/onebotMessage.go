@@ -1,6 +1,7 @@
 package onebotfilter
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
 )
@@ -9,6 +10,7 @@ type OneBotMessage struct {
 	Raw     []byte
 	Partial OneBotMessagePartial
 	Intact  map[string]json.RawMessage
+	Routed  bool // 命中了独占路由规则，已经按消息内容选择了bot应用
 }
 
 func ParseOneBotMessage(Raw []byte) *OneBotMessage {
@@ -21,6 +23,10 @@ func ParseOneBotMessage(Raw []byte) *OneBotMessage {
 	if err := json.Unmarshal(Raw, &oneBotMessage.Partial); err != nil {
 		return nil
 	}
+	if oneBotMessage.Partial.MessageFormat == "" {
+		// OneBot v11标准中没有message_format，按message的json类型判断
+		oneBotMessage.Partial.MessageFormat = messageFormatOf(oneBotMessage.Partial.UnDecodedMessage)
+	}
 	switch oneBotMessage.Partial.MessageFormat {
 	case MESSAGE_FORMAT_ARRAY:
 		if err := json.Unmarshal(oneBotMessage.Partial.UnDecodedMessage, &oneBotMessage.Partial.MessageArray); err != nil {
@@ -33,12 +39,35 @@ func ParseOneBotMessage(Raw []byte) *OneBotMessage {
 			return nil
 		}
 	default: //未知的format或没有format
+		// 通知和请求事件没有消息内容，也需要过滤
+		if oneBotMessage.Partial.PostType == POST_TYPE_NOTICE || oneBotMessage.Partial.PostType == POST_TYPE_REQUEST {
+			return oneBotMessage
+		}
 		return nil
 	}
 	return oneBotMessage
 }
 
+// 根据message的json类型判断消息格式，不是字符串或数组时返回空
+func messageFormatOf(message json.RawMessage) string {
+	message = bytes.TrimSpace(message)
+	if len(message) == 0 {
+		return ""
+	}
+	switch message[0] {
+	case '"':
+		return MESSAGE_FORMAT_STRING
+	case '[':
+		return MESSAGE_FORMAT_ARRAY
+	}
+	return ""
+}
+
 type OneBotMessagePartial struct {
+	PostType         string           `json:"post_type"`
+	NoticeType       string           `json:"notice_type"`
+	RequestType      string           `json:"request_type"`
+	SubType          string           `json:"sub_type"`
 	MessageType      string           `json:"message_type"`
 	MessageFormat    string           `json:"message_format"`
 	UnDecodedMessage json.RawMessage  `json:"message"`
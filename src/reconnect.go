@@ -0,0 +1,43 @@
+package onebotfilter
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// 重新连接的退避策略
+type backoff struct {
+	cfg      ReconnectConfig
+	attempts int // 连续重新连接的次数
+}
+
+// 记录一次重新连接，返回连接前需要等待的时间，超过最大次数时返回false
+func (b *backoff) next() (time.Duration, bool) {
+	b.attempts++
+	if b.cfg.MaxAttempts > 0 && b.attempts > b.cfg.MaxAttempts {
+		return 0, false
+	}
+	return b.delay(rand.Float64()), true
+}
+
+// 第attempts次重新连接的等待时间，r为0到1之间的随机数
+// 在delay上下jitter比例的范围内随机，结果不超过max-delay
+func (b *backoff) delay(r float64) time.Duration {
+	delay := b.cfg.InitialDelay * math.Pow(b.cfg.Multiplier, float64(b.attempts-1))
+	if b.cfg.MaxDelay > 0 && delay > b.cfg.MaxDelay {
+		delay = b.cfg.MaxDelay
+	}
+	if b.cfg.Jitter > 0 {
+		delay *= 1 + b.cfg.Jitter*(r*2-1)
+	}
+	if b.cfg.MaxDelay > 0 && delay > b.cfg.MaxDelay {
+		delay = b.cfg.MaxDelay
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// 连接成功后重置
+func (b *backoff) reset() {
+	b.attempts = 0
+}
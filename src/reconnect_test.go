@@ -0,0 +1,51 @@
+package onebotfilter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	cfg := ReconnectConfig{InitialDelay: 1, Multiplier: 2, MaxDelay: 10}
+	jittered := cfg
+	jittered.Jitter = 0.5
+	tests := []struct {
+		name     string
+		cfg      ReconnectConfig
+		attempts int
+		r        float64
+		want     time.Duration
+	}{
+		{"第一次", cfg, 1, 0.5, time.Second},
+		{"指数增长", cfg, 3, 0.5, 4 * time.Second},
+		{"不超过max-delay", cfg, 10, 0.5, 10 * time.Second},
+		{"jitter向下", jittered, 2, 0, time.Second},
+		{"jitter向上", jittered, 2, 1, 3 * time.Second},
+		{"jitter后不超过max-delay", jittered, 10, 1, 10 * time.Second},
+		{"max-delay处jitter向下", jittered, 10, 0, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := backoff{cfg: tt.cfg, attempts: tt.attempts}
+			if got := b.delay(tt.r); got != tt.want {
+				t.Errorf("delay(%v) = %v, want %v", tt.r, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	b := backoff{cfg: ReconnectConfig{InitialDelay: 1, Multiplier: 2, MaxDelay: 60, MaxAttempts: 2}}
+	for i := 1; i <= 2; i++ {
+		if _, ok := b.next(); !ok {
+			t.Fatalf("第%d次重新连接不应该停止", i)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Fatal("超过max-attempts后应该停止")
+	}
+	b.reset()
+	if d, ok := b.next(); !ok || d != time.Second {
+		t.Fatalf("reset后next() = %v, %v", d, ok)
+	}
+}
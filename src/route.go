@@ -0,0 +1,105 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// 路由规则需要的消息字段
+type routeMessage struct {
+	PostType    string `json:"post_type"`
+	MessageType string `json:"message_type"`
+	UserId      int64  `json:"user_id"`
+	GroupId     int64  `json:"group_id"`
+	RawMessage  string `json:"raw_message"`
+}
+
+// 找到消息匹配的第一个路由规则，没有匹配时返回nil
+func matchRoute(msg WsMsg) *RouteConfig {
+	if len(CONFIG.Server.Routes) == 0 || msg.MsgType != websocket.TextMessage {
+		return nil
+	}
+	var rm routeMessage
+	if err := json.Unmarshal(msg.MsgData, &rm); err != nil || rm.PostType != "message" {
+		return nil
+	}
+	for i := range CONFIG.Server.Routes {
+		if CONFIG.Server.Routes[i].match(&rm) {
+			return &CONFIG.Server.Routes[i]
+		}
+	}
+	return nil
+}
+
+// 消息是否满足规则的所有条件
+func (rc *RouteConfig) match(rm *routeMessage) bool {
+	if rc.MessageType != "" && rc.MessageType != rm.MessageType {
+		return false
+	}
+	if len(rc.GroupId) > 0 && (rm.MessageType != GROUP || !slices.Contains(rc.GroupId, rm.GroupId)) {
+		return false
+	}
+	if len(rc.UserId) > 0 && !slices.Contains(rc.UserId, rm.UserId) {
+		return false
+	}
+	if len(rc.Prefix) == 0 && len(rc.regexps) == 0 {
+		return true
+	}
+	text := strings.TrimSpace(rm.RawMessage)
+	for _, prefix := range rc.Prefix {
+		if prefix != "" && strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range rc.regexps {
+		if ok, err := pattern.MatchString(text); ok {
+			return true
+		} else if err != nil {
+			log.Printf("路由规则%s正则匹配出错的消息：%s\n", rc.Name, rm.RawMessage)
+		}
+	}
+	return false
+}
+
+// 把命中路由规则的消息发给第一个在线、订阅了并且过滤器允许这条消息的目标，都不在线时放入第一个能保存它的离线队列
+// 目标bot应用的过滤器不再检查消息内容，群号和QQ号的黑白名单、消息段和前缀替换仍然有效
+func (wss *WsServer) deliverRouted(rc *RouteConfig, msg WsMsg) {
+	msg.Routed = true
+	for _, name := range rc.Targets {
+		wsClient := wss.getWsClient(name)
+		if wsClient == nil || !wsClient.filter.Subscribed(msg) {
+			continue
+		}
+		data, ok := wsClient.filter.FilterMessage(msg)
+		if !ok {
+			continue
+		}
+		filtered := WsMsg{MsgType: msg.MsgType, MsgData: data, Filtered: true}
+		// 正在补发离线队列时，放在队列后面
+		if q := wss.getOfflineQueue(name); q != nil {
+			if q.offer(filtered) {
+				return
+			}
+		}
+		if CONFIG.Server.Debug {
+			log.Printf("路由规则%s：消息只发给%s\n", rc.Name, name)
+		}
+		if err := wsClient.writeFiltered(msg.MsgType, data); err != nil {
+			log.Printf("向 %s 发送消息出错：%v\n", name, err)
+			continue
+		}
+		return
+	}
+	for _, name := range rc.Targets {
+		if q := wss.getOfflineQueue(name); q != nil {
+			if q.offer(msg) {
+				return
+			}
+		}
+	}
+	log.Printf("路由规则%s的bot应用都不在线，丢弃了消息\n", rc.Name)
+}
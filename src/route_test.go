@@ -0,0 +1,86 @@
+package onebotfilter
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRouteMatch(t *testing.T) {
+	weather := RouteConfig{MessageType: GROUP, Prefix: []string{"/天气"}, Regex: []string{"^查询.*天气$"}, Targets: []string{"bot1"}}
+	group := RouteConfig{GroupId: []int64{5}, UserId: []int64{1}, Targets: []string{"bot1"}}
+	for _, rc := range []*RouteConfig{&weather, &group} {
+		if err := rc.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		rc   *RouteConfig
+		rm   routeMessage
+		want bool
+	}{
+		{"前缀", &weather, routeMessage{MessageType: GROUP, RawMessage: " /天气 北京"}, true},
+		{"正则", &weather, routeMessage{MessageType: GROUP, RawMessage: "查询北京天气"}, true},
+		{"都不满足", &weather, routeMessage{MessageType: GROUP, RawMessage: "你好"}, false},
+		{"消息类型不同", &weather, routeMessage{MessageType: PRIVATE, RawMessage: "/天气"}, false},
+		{"群号和QQ号", &group, routeMessage{MessageType: GROUP, GroupId: 5, UserId: 1}, true},
+		{"QQ号不同", &group, routeMessage{MessageType: GROUP, GroupId: 5, UserId: 2}, false},
+		{"私聊没有群号", &group, routeMessage{MessageType: PRIVATE, UserId: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rc.match(&tt.rm); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteConfigCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		rc      RouteConfig
+		wantErr bool
+	}{
+		{"没有目标", RouteConfig{Prefix: []string{"/a"}}, true},
+		{"没有条件", RouteConfig{Targets: []string{"bot1"}}, true},
+		{"消息类型错误", RouteConfig{MessageType: "channel", Targets: []string{"bot1"}}, true},
+		{"正则错误", RouteConfig{Regex: []string{"("}, Targets: []string{"bot1"}}, true},
+		{"正确", RouteConfig{Prefix: []string{"/a"}, Targets: []string{"bot1"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rc.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoutedFilter(t *testing.T) {
+	f := (&Filter{Name: "bot1"}).Compile(BotAppsConfig{
+		Name:         "bot1",
+		UserId:       IdConfig{Mode: BLACKLIST, Ids: []int64{9}},
+		GroupMessage: MessageConfig{Mode: WHITELIST, Prefix: []string{"/help"}},
+	})
+	event := func(userId string) []byte {
+		return []byte(`{"post_type":"message","message_type":"group","group_id":5,"user_id":` + userId + `,"raw_message":"/天气 北京","message":"/天气 北京"}`)
+	}
+	tests := []struct {
+		name string
+		msg  WsMsg
+		want bool
+	}{
+		{"路由的消息不检查消息内容", WsMsg{MsgType: websocket.TextMessage, MsgData: event("1"), Routed: true}, true},
+		{"路由的消息仍然检查QQ黑名单", WsMsg{MsgType: websocket.TextMessage, MsgData: event("9"), Routed: true}, false},
+		{"没有路由的消息检查消息内容", WsMsg{MsgType: websocket.TextMessage, MsgData: event("1")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := f.FilterMessage(tt.msg); got != tt.want {
+				t.Errorf("FilterMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
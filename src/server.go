@@ -2,65 +2,160 @@ package onebotfilter
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type WsServer struct {
+	SelfId    string //OneBot账号，来自x-self-id
 	Conn      *websocket.Conn
 	WsClients []*WsClient
 	readChan  chan WsMsg //从OneBot客户端读取到的消息
 	writeChan chan WsMsg //写入到OneBot客户端的消息
-	// mutex     sync.Mutex
+	mutex     sync.Mutex //保护WsClients
+
+	connMutex    sync.Mutex               // 保证同一个账号只连接一个OneBot客户端
+	connCtx      context.Context          // 当前OneBot客户端连接的context，连接断开后取消
+	echoSeq      atomic.Uint64            // 生成echo的序号
+	pending      map[string]pendingAction // 等待响应的动作请求，key为替换后的echo
+	pendingMutex sync.Mutex
+
+	botApps       map[string]*BotAppStatus // bot应用的状态，key为bot应用的名字
+	offlineQueues map[string]*offlineQueue // bot应用的离线队列，key为bot应用的名字
+	statusMutex   sync.Mutex
+
+	traffic *traffic      // 当前OneBot客户端连接的流量统计
+	online  chan struct{} // OneBot客户端连接时关闭，断开后替换为新的通道
+
+	contests       map[string]*replyContest // 回复仲裁，key为被回复的消息id
+	recentMessages map[string]recentMessage // 每个会话最近的消息，key为会话
+	arbMutex       sync.Mutex
+}
+
+// 设置OneBot客户端的连接，同一个账号只能连接一个OneBot客户端
+func (wss *WsServer) Attach(conn *websocket.Conn) error {
+	wss.connMutex.Lock()
+	defer wss.connMutex.Unlock()
+	if wss.Conn != nil {
+		return fmt.Errorf("账号%s已经连接了OneBot客户端", wss.SelfId)
+	}
+	CONFIG.Server.Compression.apply(conn)
+	wss.Conn = conn
+	wss.traffic = trafficOf(conn)
+	if wss.online == nil {
+		wss.online = make(chan struct{})
+	}
+	close(wss.online)
+	return nil
 }
 
 // 处理与OneBot客户端的连接
 func (wss *WsServer) WsServerHandler() error {
 	ctx, ctxCancel := context.WithCancel(context.Background())
-	wss.readChan = make(chan WsMsg)
-	wss.writeChan = make(chan WsMsg)
-	go wss.readLoop(ctx)       //开启读取OneBot客户端消息协程
-	go wss.writeLoop(ctx)      //开启写入OneBot客户端消息携程
-	defer wss.close(ctxCancel) //注册关闭方法
+	wss.connMutex.Lock()
+	if wss.readChan == nil {
+		// 通道在连接之间复用，不会关闭，避免向已关闭的通道写入
+		wss.readChan = make(chan WsMsg)
+		wss.writeChan = make(chan WsMsg)
+	}
+	wss.connCtx = ctx
+	// 本次连接使用的conn和traffic，close之后wss.Conn会被置为nil
+	conn, traffic := wss.Conn, wss.traffic
+	wss.connMutex.Unlock()
+	go wss.readLoop(ctx)                 //开启读取OneBot客户端消息协程
+	go wss.writeLoop(ctx, conn, traffic) //开启写入OneBot客户端消息携程
+	defer wss.close(ctxCancel)           //注册关闭方法
+	startKeepalive(ctx, conn, CONFIG.Server.Keepalive)
+	wss.notifyLifecycle(LIFECYCLE_ENABLE)
 	for {
-		mt, msg, err := wss.Conn.ReadMessage()
+		mt, msg, err := conn.ReadMessage()
 		if err != nil {
 			return err
 		}
-		wss.readChan <- WsMsg{mt, msg}
+		extendReadDeadline(conn, CONFIG.Server.Keepalive)
+		traffic.payloadIn.Add(uint64(len(msg)))
+		wss.readChan <- WsMsg{MsgType: mt, MsgData: msg}
 	}
 	// return errors.New("读取消息循环已结束")
 }
 
+// 向OneBot客户端发送bot应用的动作请求，会替换echo以便把响应送回给该bot应用
+func (wss *WsServer) SendAction(clientName string, mt int, msg []byte) error {
+	var key string
+	if mt == websocket.TextMessage {
+		msg, key = wss.wrapAction(clientName, msg, nil)
+	}
+	err := wss.WriteMessage(mt, msg)
+	if err != nil && key != "" {
+		wss.removePending(key)
+	}
+	return err
+}
+
+// 向OneBot客户端发送动作请求，并等待响应（响应中的echo会被还原）
+func (wss *WsServer) CallAction(clientName string, msg []byte, timeout time.Duration) ([]byte, error) {
+	respChan := make(chan []byte, 1)
+	msg, key := wss.wrapAction(clientName, msg, respChan)
+	if key == "" {
+		return nil, errors.New("无法解析的动作请求")
+	}
+	if err := wss.WriteMessage(websocket.TextMessage, msg); err != nil {
+		wss.removePending(key)
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-time.After(timeout):
+		wss.removePending(key)
+		return nil, errors.New("等待OneBot客户端响应超时")
+	}
+}
+
 // 向OneBot客户端写入消息
 func (wss *WsServer) WriteMessage(mt int, msg []byte) error {
-	if wss.Conn == nil {
+	wss.connMutex.Lock()
+	conn, ctx := wss.Conn, wss.connCtx
+	wss.connMutex.Unlock()
+	if conn == nil || ctx == nil {
 		return errors.New("没有连接到OneBot客户端")
 	}
-	wss.writeChan <- WsMsg{mt, msg}
-	return nil
+	select {
+	case wss.writeChan <- WsMsg{MsgType: mt, MsgData: msg}:
+		return nil
+	case <-ctx.Done():
+		return errors.New("OneBot客户端连接已断开")
+	}
 }
 
 // 添加bot应用端
 func (wss *WsServer) AddWsClient(wsClient *WsClient) error {
-	// wss.mutex.Lock()
-	// defer wss.mutex.Unlock()
+	// 在获取mutex之前获取状态，statusMutex和mutex不能嵌套获取
+	status := wss.botAppStatus(wsClient.Name)
+	wss.mutex.Lock()
+	defer wss.mutex.Unlock()
 	for _, c := range wss.WsClients {
 		if c.Name == wsClient.Name {
 			return fmt.Errorf("已经连接过%s", wsClient.Name)
 		}
 	}
+	wsClient.status = status
 	wss.WsClients = append(wss.WsClients, wsClient)
 	return nil
 }
 
 // 删除bot应用端
 func (wss *WsServer) RemoveWsClient(name string) {
-	// wss.mutex.Lock()
-	// defer wss.mutex.Unlock()
+	wss.mutex.Lock()
+	defer wss.mutex.Unlock()
 	for i, c := range wss.WsClients {
 		if c.Name == name {
 			wss.WsClients = append(wss.WsClients[:i], wss.WsClients[i+1:]...) //从列表中删除
@@ -72,12 +167,79 @@ func (wss *WsServer) RemoveWsClient(name string) {
 // 关闭连接
 func (wss *WsServer) close(ctxCancel context.CancelFunc) {
 	ctxCancel()
+	wss.connMutex.Lock()
 	if wss.Conn != nil {
 		wss.Conn.Close()
 	}
-	close(wss.readChan)
-	close(wss.writeChan)
 	wss.Conn = nil
+	wss.connCtx = nil
+	wss.online = make(chan struct{})
+	wss.connMutex.Unlock()
+	// 不会再收到响应了，直接回复失败
+	wss.failPending(RETCODE_OFFLINE, "OneBot客户端连接已断开")
+	wss.notifyLifecycle(LIFECYCLE_DISABLE)
+	wss.applyOfflinePolicy()
+}
+
+// 等待OneBot客户端连接，返回的通道在已连接时关闭
+func (wss *WsServer) whenOnline() <-chan struct{} {
+	wss.connMutex.Lock()
+	defer wss.connMutex.Unlock()
+	if wss.online == nil {
+		wss.online = make(chan struct{})
+	}
+	return wss.online
+}
+
+// OneBot客户端断开后，按server.offline-policy处理bot应用
+func (wss *WsServer) applyOfflinePolicy() {
+	if shuttingDown() {
+		// 退出时由Shutdown关闭所有连接
+		return
+	}
+	policy := CONFIG.Server.OfflinePolicy
+	switch policy {
+	case OFFLINE_HOLD:
+		log.Printf("账号%s的OneBot客户端已断开，保持bot应用的连接（offline-policy: %s）\n", wss.SelfId, policy)
+	case OFFLINE_DISABLE:
+		log.Printf("账号%s的OneBot客户端已断开，已向bot应用发送lifecycle disable事件（offline-policy: %s）\n", wss.SelfId, policy)
+	case OFFLINE_DISCONNECT:
+		log.Printf("账号%s的OneBot客户端已断开，断开所有bot应用，等待OneBot客户端重新连接（offline-policy: %s）\n", wss.SelfId, policy)
+		closeData := websocket.FormatCloseMessage(websocket.CloseGoingAway, "OneBot客户端已断开")
+		closeCtx, cancel := context.WithTimeout(context.Background(), CLOSE_TIMEOUT)
+		defer cancel()
+		for _, wsClient := range wss.clients() {
+			// http post没有连接可以断开
+			if wsClient.poster != nil {
+				continue
+			}
+			// 关闭帧排在之前的消息之后，发送队列一直没有空位时直接断开
+			wsClient.closedOffline.Store(true)
+			wsClient.pushClose(closeCtx, closeData)
+		}
+	}
+}
+
+// offline-policy为disconnect时，OneBot客户端没有连接就不连接bot应用
+func (wss *WsServer) holdBotApps() bool {
+	return CONFIG.Server.OfflinePolicy == OFFLINE_DISCONNECT && !wss.Connected()
+}
+
+// 当前所有bot应用端的副本，可以在遍历时修改列表
+func (wss *WsServer) clients() []*WsClient {
+	wss.mutex.Lock()
+	defer wss.mutex.Unlock()
+	return slices.Clone(wss.WsClients)
+}
+
+// 按名字查找bot应用端
+func (wss *WsServer) getWsClient(name string) *WsClient {
+	for _, c := range wss.clients() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
 }
 
 // 处理从OneBot客户端读取到的消息
@@ -85,13 +247,46 @@ func (wss *WsServer) readLoop(ctx context.Context) {
 	for {
 		select {
 		case msg := <-wss.readChan:
-			// 转发给所有bot应用
-			for _, wsClient := range wss.WsClients {
-				go func(wsClient *WsClient, mt int, msg []byte) {
-					if err := wsClient.WriteMessage(mt, msg); err != nil {
-						log.Printf("向 %s 发送消息出错：%v\n", wsClient.Name, err)
+			// 动作响应只发给发出请求的bot应用
+			if msg.MsgType == websocket.TextMessage {
+				if pa, data, ok := wss.unwrapResponse(msg.MsgData); ok {
+					if pa.clientName == "" {
+						if CONFIG.Server.Debug {
+							log.Printf("找不到动作响应的接收者，已丢弃：%s\n", msg.MsgData)
+						}
+						continue
 					}
-				}(wsClient, msg.MsgType, msg.MsgData)
+					wss.replyPending(pa, data)
+					continue
+				}
+			}
+			// 由本程序生成的元事件，不转发OneBot客户端发来的
+			if msg.MsgType == websocket.TextMessage {
+				var head oneBotFrameHead
+				if err := json.Unmarshal(msg.MsgData, &head); err == nil && isReplacedMetaEvent(head) {
+					continue
+				}
+			}
+			// 记录消息，用于关联bot应用的回复
+			if msg.MsgType == websocket.TextMessage {
+				wss.recordMessage(msg.MsgData)
+			}
+			// 命中独占路由规则的消息只发给一个bot应用
+			if route := matchRoute(msg); route != nil {
+				wss.deliverRouted(route, msg)
+				continue
+			}
+			// 离线或正在补发的bot应用，事件保存到离线队列中
+			queued := wss.offerOfflineQueues(msg)
+			// 事件转发给所有bot应用
+			for _, wsClient := range wss.clients() {
+				if slices.Contains(queued, wsClient.Name) {
+					continue
+				}
+				// 放入bot应用的发送队列，保证顺序
+				if err := wsClient.WriteMessage(msg.MsgType, msg.MsgData); err != nil {
+					log.Printf("向 %s 发送消息出错：%v\n", wsClient.Name, err)
+				}
 			}
 		case <-ctx.Done():
 			return
@@ -99,16 +294,40 @@ func (wss *WsServer) readLoop(ctx context.Context) {
 	}
 }
 
-// 处理写入OneBot客户端的消息
-func (wss *WsServer) writeLoop(ctx context.Context) {
+// 处理写入OneBot客户端的消息，conn和traffic属于ctx对应的连接
+func (wss *WsServer) writeLoop(ctx context.Context, conn *websocket.Conn, traffic *traffic) {
 	for {
 		select {
 		case msg := <-wss.writeChan:
-			if err := wss.Conn.WriteMessage(msg.MsgType, msg.MsgData); err != nil {
+			if ctx.Err() != nil {
+				// writeChan在连接之间复用，连接已经断开时取到的消息可能属于新的连接
+				wss.handBack(msg)
+				return
+			}
+			if err := writeWithDeadline(conn, CONFIG.Server.Keepalive, msg.MsgType, msg.MsgData); err != nil {
 				log.Println("写入到OneBot客户端出错：", err)
+				// 写入出错后连接已经不可用，关闭连接使读取循环结束
+				conn.Close()
+				continue
 			}
+			traffic.payloadOut.Add(uint64(len(msg.MsgData)))
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// 把旧连接的写入循环取到的消息交给当前连接，当前连接也断开时丢弃
+// 属于旧连接的动作请求已经由close回复了失败的响应
+func (wss *WsServer) handBack(msg WsMsg) {
+	wss.connMutex.Lock()
+	ctx := wss.connCtx
+	wss.connMutex.Unlock()
+	if ctx == nil {
+		return
+	}
+	select {
+	case wss.writeChan <- msg:
+	case <-ctx.Done():
+	}
+}
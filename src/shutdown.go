@@ -0,0 +1,128 @@
+package onebotfilter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 收到退出信号后取消，用于停止重新连接和心跳
+var shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+
+// 开始退出：停止重新连接和心跳，正在等待响应的动作请求仍然等待OneBot客户端的响应
+func BeginShutdown() {
+	beginShutdown()
+}
+
+// 是否正在退出
+func shuttingDown() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// 等待一段时间，正在退出时立即返回false
+func sleepUnlessShutdown(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-shutdownCtx.Done():
+		return false
+	}
+}
+
+// 优雅退出：等待正在进行的动作请求得到响应，然后向OneBot客户端发送关闭帧，
+// 等待发送队列中的消息发送完毕后再向bot应用发送关闭帧。ctx超时后直接断开所有连接并返回错误
+func Shutdown(ctx context.Context) error {
+	beginShutdown()
+	servers := allWsServers()
+	// 动作请求的响应还需要OneBot客户端的连接
+	err := waitUntil(ctx, func() bool {
+		for _, wss := range servers {
+			if wss.pendingCount() > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("等待动作响应超时")
+	}
+	closeData := websocket.FormatCloseMessage(websocket.CloseGoingAway, "OneBotFilter正在退出")
+	for _, wss := range servers {
+		// 没有连接时会返回错误，不需要处理
+		wss.WriteMessage(websocket.CloseMessage, closeData)
+	}
+	// OneBot客户端回复关闭帧后，WsServerHandler才会结束，之前收到的事件都已经放入发送队列
+	err = waitUntil(ctx, func() bool {
+		for _, wss := range servers {
+			if wss.Connected() {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("等待OneBot客户端关闭连接超时")
+	}
+	for _, wss := range servers {
+		for _, wsClient := range wss.clients() {
+			// 关闭帧排在发送队列中的消息之后
+			wsClient.pushClose(ctx, closeData)
+		}
+	}
+	err = waitUntil(ctx, func() bool {
+		for _, wss := range servers {
+			if len(wss.clients()) > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		return nil
+	}
+	// 超时，直接断开剩下的连接
+	for _, wss := range servers {
+		wss.connMutex.Lock()
+		if wss.Conn != nil {
+			wss.Conn.Close()
+		}
+		wss.connMutex.Unlock()
+		for _, wsClient := range wss.clients() {
+			wsClient.close()
+		}
+	}
+	return errors.New("等待连接关闭超时，已直接断开")
+}
+
+// 每隔一段时间检查一次，直到满足条件或者ctx结束
+func waitUntil(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// 是否连接了OneBot客户端
+func (wss *WsServer) Connected() bool {
+	wss.connMutex.Lock()
+	defer wss.connMutex.Unlock()
+	return wss.Conn != nil
+}
+
+// 等待响应的动作请求数量
+func (wss *WsServer) pendingCount() int {
+	wss.pendingMutex.Lock()
+	defer wss.pendingMutex.Unlock()
+	return len(wss.pending)
+}
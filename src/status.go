@@ -0,0 +1,136 @@
+package onebotfilter
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bot应用的连接状态
+const (
+	STATE_CONNECTING   = "connecting"   // 正在连接
+	STATE_CONNECTED    = "connected"    // 已连接
+	STATE_BACKING_OFF  = "backing-off"  // 连接失败，等待重新连接
+	STATE_GIVEN_UP     = "given-up"     // 超过最大重试次数，不再连接
+	STATE_DISCONNECTED = "disconnected" // 等待bot应用主动连接
+	STATE_WAITING      = "waiting"      // 等待OneBot客户端连接后再连接bot应用
+)
+
+// bot应用的状态，用于上报
+type BotAppStatus struct {
+	mutex     sync.Mutex
+	Name      string         `json:"name"`
+	State     string         `json:"state"`
+	Since     time.Time      `json:"since"`                // 进入当前状态的时间
+	Attempts  int            `json:"attempts"`             // 连续失败的次数
+	LastError string         `json:"last_error,omitempty"` // 最后一次连接失败的原因
+	NextRetry time.Time      `json:"next_retry,omitzero"`  // 下一次重新连接的时间
+	Queued    int            `json:"queued,omitempty"`     // 离线队列中的事件数量
+	Depth     int            `json:"depth"`                // 发送队列中的消息数量
+	Dropped   uint64         `json:"dropped"`              // 发送队列满时丢弃的消息数量
+	Traffic   *TrafficStatus `json:"traffic,omitempty"`    // 当前连接的流量统计
+}
+
+// 账号的状态，用于上报
+type WsServerStatus struct {
+	SelfId    string          `json:"self_id"`
+	Connected bool            `json:"connected"`         // 是否连接了OneBot客户端
+	Traffic   *TrafficStatus  `json:"traffic,omitempty"` // 当前OneBot客户端连接的流量统计
+	BotApps   []*BotAppStatus `json:"bot_apps"`
+}
+
+// 修改bot应用的状态
+func (bas *BotAppStatus) set(state string, attempts int, err error, nextRetry time.Time) {
+	bas.mutex.Lock()
+	defer bas.mutex.Unlock()
+	if bas.State != state {
+		bas.Since = time.Now()
+	}
+	bas.State = state
+	bas.Attempts = attempts
+	bas.NextRetry = nextRetry
+	if err != nil {
+		bas.LastError = err.Error()
+	}
+}
+
+// 增加丢弃的消息数量，返回增加后的数量
+func (bas *BotAppStatus) addDropped() uint64 {
+	bas.mutex.Lock()
+	defer bas.mutex.Unlock()
+	bas.Dropped++
+	return bas.Dropped
+}
+
+// 获取bot应用的状态，没有时创建
+func (wss *WsServer) botAppStatus(name string) *BotAppStatus {
+	wss.statusMutex.Lock()
+	defer wss.statusMutex.Unlock()
+	if wss.botApps == nil {
+		wss.botApps = map[string]*BotAppStatus{}
+	}
+	bas, ok := wss.botApps[name]
+	if !ok {
+		bas = &BotAppStatus{Name: name, Since: time.Now()}
+		wss.botApps[name] = bas
+	}
+	return bas
+}
+
+// 账号当前的状态
+func (wss *WsServer) Status() WsServerStatus {
+	status := WsServerStatus{SelfId: wss.SelfId}
+	wss.connMutex.Lock()
+	if wss.Conn != nil {
+		status.Connected = true
+		status.Traffic = wss.traffic.status()
+	}
+	wss.connMutex.Unlock()
+	// 复制后释放statusMutex，再查找bot应用的连接，避免与AddWsClient互相等待
+	wss.statusMutex.Lock()
+	botApps := maps.Clone(wss.botApps)
+	offlineQueues := maps.Clone(wss.offlineQueues)
+	wss.statusMutex.Unlock()
+	for _, bas := range botApps {
+		bas.mutex.Lock()
+		copied := &BotAppStatus{
+			Name:      bas.Name,
+			State:     bas.State,
+			Since:     bas.Since,
+			Attempts:  bas.Attempts,
+			LastError: bas.LastError,
+			NextRetry: bas.NextRetry,
+			Dropped:   bas.Dropped,
+		}
+		bas.mutex.Unlock()
+		if q := offlineQueues[bas.Name]; q != nil {
+			copied.Queued = q.len()
+		}
+		if wc := wss.getWsClient(bas.Name); wc != nil {
+			copied.Depth = wc.queueDepth()
+			copied.Traffic = wc.traffic.status()
+		}
+		status.BotApps = append(status.BotApps, copied)
+	}
+	sort.Slice(status.BotApps, func(i, j int) bool { return status.BotApps[i].Name < status.BotApps[j].Name })
+	return status
+}
+
+// 以json返回所有账号和bot应用的状态，使用server.access-token验证
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if status := CheckAccessToken(r, CONFIG.Server.AccessToken); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	servers := allWsServers()
+	result := make([]WsServerStatus, 0, len(servers))
+	for _, wss := range servers {
+		result = append(result, wss.Status())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SelfId < result[j].SelfId })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
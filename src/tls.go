@@ -0,0 +1,111 @@
+package onebotfilter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 本程序监听时使用的证书，证书文件修改后会自动重新加载
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// 用于tls.Config.GetCertificate，证书或私钥文件的修改时间变化时重新加载
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	modTime, err := latestModTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			// 可能是证书文件正在写入，继续使用旧证书
+			log.Println("重新加载证书出错，继续使用旧证书：", err)
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil {
+		log.Println("已重新加载证书：", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return cr.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// 生成连接bot应用时使用的tls配置，没有配置时返回nil，使用默认配置
+func (tc *TLSClientConfig) Build() (*tls.Config, error) {
+	if tc.CaFile == "" && tc.CertFile == "" && tc.ServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: tc.ServerName,
+	}
+	if tc.CaFile != "" {
+		pem, err := os.ReadFile(tc.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s中没有可用的证书", tc.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (tc *TLSClientConfig) Check() error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return errors.New("tls.cert-file和tls.key-file需要同时配置")
+	}
+	_, err := tc.Build()
+	return err
+}
@@ -0,0 +1,89 @@
+package onebotfilter
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// 一个连接的流量统计，对比wire和payload可以看出压缩节省了多少
+type traffic struct {
+	wireIn     atomic.Uint64 // 实际收到的字节数，包括ws帧头和tls，启用压缩时为压缩后的大小
+	wireOut    atomic.Uint64 // 实际发送的字节数
+	payloadIn  atomic.Uint64 // 收到的消息内容的字节数
+	payloadOut atomic.Uint64 // 发送的消息内容的字节数
+}
+
+// 流量统计，用于上报
+type TrafficStatus struct {
+	WireIn     uint64 `json:"wire_in"`
+	WireOut    uint64 `json:"wire_out"`
+	PayloadIn  uint64 `json:"payload_in"`
+	PayloadOut uint64 `json:"payload_out"`
+}
+
+func (t *traffic) status() *TrafficStatus {
+	return &TrafficStatus{
+		WireIn:     t.wireIn.Load(),
+		WireOut:    t.wireOut.Load(),
+		PayloadIn:  t.payloadIn.Load(),
+		PayloadOut: t.payloadOut.Load(),
+	}
+}
+
+// 统计收发字节数的连接
+type countingConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	cc.traffic.wireIn.Add(uint64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.traffic.wireOut.Add(uint64(n))
+	return n, err
+}
+
+// 为每个接受的连接统计流量
+type countingListener struct {
+	net.Listener
+}
+
+func CountingListener(l net.Listener) net.Listener {
+	return countingListener{l}
+}
+
+func (cl countingListener) Accept() (net.Conn, error) {
+	conn, err := cl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, traffic: &traffic{}}, nil
+}
+
+// ws连接底层的流量统计，找不到时返回新的，只统计消息内容
+func trafficOf(conn *websocket.Conn) *traffic {
+	c := conn.NetConn()
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if cc, ok := c.(*countingConn); ok {
+		return cc.traffic
+	}
+	return &traffic{}
+}
+
+// 设置压缩等级，只有双方协商启用了压缩时才会压缩
+func (cc *CompressionConfig) apply(conn *websocket.Conn) {
+	if conn == nil || !cc.Enable {
+		return
+	}
+	conn.SetCompressionLevel(cc.Level)
+}
@@ -0,0 +1,92 @@
+package onebotfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const UNIX_URI_PREFIX = "unix://"
+
+// 在unix socket上监听，会删除上次没有清理的socket文件，并设置文件权限
+// socket文件还能连接时，说明有其他程序正在使用，不会删除
+func ListenUnix(cfg UnixSocketConfig) (net.Listener, error) {
+	if info, err := os.Stat(cfg.Path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s已经存在，且不是socket文件", cfg.Path)
+		}
+		if conn, err := net.DialTimeout("unix", cfg.Path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s正在被其他程序使用", cfg.Path)
+		}
+		if err = os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(cfg.Path, cfg.fileMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// 解析八进制的文件权限
+func parseFileMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("文件权限配置错误：%s", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// 是否是通过unix socket发来的请求，这样的请求由socket文件权限控制，不检查ip
+func isUnixRequest(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// 解析unix://地址，格式为unix:///path/to/bot.sock:/ws/path，没有路径时为/
+// 返回socket文件路径和替换为scheme://localhost的地址，不是unix://地址时原样返回
+func parseUnixUri(uri, scheme string) (sock, newUri string, err error) {
+	if !strings.HasPrefix(uri, UNIX_URI_PREFIX) {
+		return "", uri, nil
+	}
+	rest, query := strings.TrimPrefix(uri, UNIX_URI_PREFIX), ""
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, query = rest[:i], rest[i:]
+	}
+	sock, path := rest, "/"
+	if i := strings.Index(rest, ":/"); i >= 0 {
+		sock, path = rest[:i], rest[i+1:]
+	}
+	if sock == "" {
+		return "", "", errors.New("unix地址缺少socket文件路径：" + uri)
+	}
+	return sock, scheme + "://localhost" + path + query, nil
+}
+
+// 建立连接的方法，sock不为空时连接这个unix socket，连接都计入流量统计
+func (t *traffic) dialFunc(sock string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if sock != "" {
+			network, addr = "unix", sock
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, traffic: t}, nil
+	}
+}
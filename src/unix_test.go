@@ -0,0 +1,52 @@
+package onebotfilter
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUnixUri(t *testing.T) {
+	tests := []struct {
+		uri, scheme string
+		sock, want  string
+		wantErr     bool
+	}{
+		{"ws://example.com/ws", "ws", "", "ws://example.com/ws", false},
+		{"unix:///run/bot.sock", "ws", "/run/bot.sock", "ws://localhost/", false},
+		{"unix:///run/bot.sock:/onebot/v11/ws", "ws", "/run/bot.sock", "ws://localhost/onebot/v11/ws", false},
+		{"unix:///run/bot.sock:/ws?access_token=abc", "ws", "/run/bot.sock", "ws://localhost/ws?access_token=abc", false},
+		{"unix:///run/bot.sock?a=1", "http", "/run/bot.sock", "http://localhost/?a=1", false},
+		{"unix://:/ws", "ws", "", "", true},
+	}
+	for _, tt := range tests {
+		sock, uri, err := parseUnixUri(tt.uri, tt.scheme)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUnixUri(%q) err = %v", tt.uri, err)
+			continue
+		}
+		if sock != tt.sock || uri != tt.want {
+			t.Errorf("parseUnixUri(%q) = %q, %q, want %q, %q", tt.uri, sock, uri, tt.sock, tt.want)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	cfg := UnixSocketConfig{Path: filepath.Join(t.TempDir(), "filter.sock"), fileMode: 0o600}
+	listener, err := ListenUnix(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 正在使用的socket不能删除
+	if _, err := ListenUnix(cfg); err == nil {
+		t.Fatal("正在使用的socket应该返回错误")
+	}
+	// 上次没有清理的socket文件可以删除
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = ListenUnix(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}